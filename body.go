@@ -2,12 +2,110 @@ package http2
 
 import (
 	"bytes"
+	"fmt"
+	"sync"
 )
 
+// Body is a pipe from DATA Frames to reader of
+// http.Request.Body/http.Response.Body.
+// Read blocks until DATA Frame arrives, and
+// read size is notified to onRead so that
+// WINDOW_UPDATE is sent only as reader consumes.
 type Body struct {
-	bytes.Buffer
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    bytes.Buffer
+	err    error // returned from Read after buf drained
+	closed bool  // closed by reader
+	onRead func(n int)
 }
 
+func NewBody(onRead func(n int)) *Body {
+	body := &Body{
+		onRead: onRead,
+	}
+	body.cond = sync.NewCond(&body.mu)
+	return body
+}
+
+// Write appends payload of DATA Frame.
+// it never blocks, size is limited by flow control.
+func (b *Body) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		// nobody reads, so release window immediately
+		b.release(len(p))
+		return len(p), nil
+	}
+	if b.err != nil {
+		b.mu.Unlock()
+		return 0, fmt.Errorf("write to body after closed: %v", b.err)
+	}
+	n, err := b.buf.Write(p)
+	b.cond.Signal()
+	b.mu.Unlock()
+	return n, err
+}
+
+// CloseWithError makes Read return err after buffered data.
+// io.EOF for END_STREAM, otherwise reason of reset.
+func (b *Body) CloseWithError(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.cond.Broadcast()
+}
+
+func (b *Body) Read(p []byte) (n int, err error) {
+	b.mu.Lock()
+	for b.buf.Len() == 0 && b.err == nil && !b.closed {
+		b.cond.Wait()
+	}
+	if b.closed {
+		b.mu.Unlock()
+		return 0, fmt.Errorf("read on closed body")
+	}
+	if b.buf.Len() == 0 {
+		err = b.err
+		b.mu.Unlock()
+		return 0, err
+	}
+	n, err = b.buf.Read(p)
+	b.mu.Unlock()
+
+	b.release(n)
+	return n, err
+}
+
+// Close discards buffered and following data.
 func (b *Body) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	n := b.buf.Len()
+	b.buf.Reset()
+	b.cond.Broadcast()
+	b.mu.Unlock()
+
+	b.release(n)
 	return nil
 }
+
+// Len returns buffered size which is not read yet
+func (b *Body) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Len()
+}
+
+func (b *Body) release(n int) {
+	if n > 0 && b.onRead != nil {
+		b.onRead(n)
+	}
+}
@@ -1,6 +1,9 @@
 package http2
 
 import (
+	"context"
+	"crypto/rand"
+	"errors"
 	"fmt"
 	. "github.com/Jxck/color"
 	"github.com/Jxck/hpack"
@@ -8,6 +11,10 @@ import (
 	. "github.com/Jxck/logger"
 	"io"
 	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -15,115 +22,779 @@ func init() {
 	log.SetFlags(log.Lshortfile)
 }
 
+// Conn is used from ReadLoop, WriteLoop, and goroutines of
+// each stream (handler or RoundTrip).
+// Streams, GoAwayReceived, GoAwayLastStreamID, GoAwayErrorCode,
+// GoAwaySent, LastStreamID, lastLocalStreamID, pings and lastRead are protected by mu,
+// Settings, PeerSettings and pendingSettings are protected by settingsMu.
+// Settings are ours acknowledged by peer, and changed only in ReadLoop.
+// frames are written only by WriteLoop via Write.
 type Conn struct {
-	RW           io.ReadWriter
-	HpackContext *hpack.Context
-	LastStreamID uint32
-	Window       *Window
-	Settings     map[SettingsID]int32
-	PeerSettings map[SettingsID]int32
-	Streams      map[uint32]*Stream
-	WriteChan    chan Frame
-	CallBack     func(stream *Stream)
+	RW             io.ReadWriter
+	HpackEncoder   *hpack.Context // for header blocks to send
+	HpackDecoder   *hpack.Context // for header blocks received
+	LastStreamID   uint32
+	Window         *Window
+	Settings       Settings
+	PeerSettings   Settings
+	Streams        map[uint32]*Stream
+	WriteChan      chan Frame
+	CallBack       func(stream *Stream)
+	PushCallBack   PushCallBack
+	GoAwayReceived bool
+	GoAwaySent     bool // final GOAWAY, new streams are ignored
+
+	// last stream id and error code of GOAWAY from peer
+	GoAwayLastStreamID uint32
+	GoAwayErrorCode    ErrorCode
+
+	// header block waiting CONTINUATION
+	HeaderBlock        Frame
+	HeaderBlockBuffer  []byte
+	MaxHeaderBlockSize int
+
+	// connection is closed with GOAWAY when no stream is active for IdleTimeout,
+	// next frame doesn't come in ReadTimeout while peer is sending streams,
+	// or header block (and preface) is not completed in ReadHeaderTimeout.
+	// frame should be written in WriteTimeout. 0 means no timeout.
+	IdleTimeout       time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	ReadHeaderTimeout time.Duration
+
+	// connection is closed with GOAWAY SETTINGS_TIMEOUT
+	// if ACK of SETTINGS doesn't come in SettingsTimeout.
+	// 0 means no timeout.
+	SettingsTimeout time.Duration
+
+	// budgets of frames against resource exhaustion attacks,
+	// applied when ReadLoop starts.
+	Limits Limits
+
+	// limit of dynamic table size update from peer's encoder,
+	// our SETTINGS_HEADER_TABLE_SIZE acknowledged. changed only in ReadLoop
+	decoderTableSize uint32
+
+	// dynamic table size of encoder, follows peer's SETTINGS_HEADER_TABLE_SIZE
+	// and the change is signaled at the beginning of next header block.
+	encoderTableSize uint32
+	tableSizeUpdate  bool
+
+	// peer initiated streams whose CallBack (handler) has not returned,
+	// which count toward MAX_CONCURRENT_STREAMS even after reset.
+	handlers map[uint32]struct{}
+
+	mu         sync.Mutex // protects Streams, handlers, closedStreams, GoAwayReceived, LastStreamID
+	settingsMu sync.Mutex // protects Settings, PeerSettings
+	openMu     sync.Mutex // keeps order of stream ids we initiate
+	headerMu   sync.Mutex // keeps order of header blocks, protects encoder
+
+	closed    chan struct{} // closed when connection is closed
+	closeOnce sync.Once
+
+	// SETTINGS sent but not acknowledged yet, in order of sending
+	pendingSettings []*pendingSettings
+
+	// PING waiting ACK, opaque data => channel closed by ACK
+	pings map[[8]byte]chan struct{}
+
+	// time of the last frame received, for keepalive
+	lastRead time.Time
+
+	// time when stream was active at last, for IdleTimeout
+	lastActive time.Time
+
+	// time when header block started, changed only in ReadLoop
+	headerBlockStart time.Time
+
+	// frames counted against Limits, used only in ReadLoop
+	budgets *budgets
+
+	// closed when the first SETTINGS from peer is applied
+	// changed only in ReadLoop
+	peerSettingsReceived chan struct{}
+	settingsReceived     bool
+
+	// client initiates odd streams, server initiates even streams
+	client bool
+
+	// host:port client connected to, which pushed request should match
+	authority string
+
+	// largest id of streams we opened or reserved,
+	// LastStreamID is the one of peer
+	lastLocalStreamID uint32
+
+	// id of next stream we initiate, odd for client and even for server.
+	// 0 means no stream was initiated yet.
+	nextStreamID uint32
+
+	// streams removed from Streams recently, for frames arriving after close
+	closedStreams *closedStreams
+
+	// streams reserved by Transport but not added yet
+	reservedStreams int32
+}
+
+// ErrStreamIDExhausted is returned when connection used all stream ids,
+// new streams should be opened on new connection.
+var ErrStreamIDExhausted = errors.New("stream ids are exhausted")
+
+// ErrConnClosed is returned when stream is added to closed connection,
+// the stream was never sent and can be opened on new connection.
+var ErrConnClosed = errors.New("connection was closed")
+
+// Frames are written by WriteLoop in a row,
+// no other frame is written between them.
+// (e.g. HEADERS and CONTINUATION)
+type Frames []Frame
+
+func (frames Frames) Write(w io.Writer) (err error) {
+	for _, frame := range frames {
+		err = frame.Write(w)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (frames Frames) Read(r io.Reader) error {
+	return fmt.Errorf("Frames can not be read")
+}
+
+// header of the first frame
+func (frames Frames) Header() *FrameHeader {
+	return frames[0].Header()
+}
+
+func (frames Frames) String() string {
+	strs := make([]string, 0, len(frames))
+	for _, frame := range frames {
+		strs = append(strs, frame.String())
+	}
+	return strings.Join(strs, "\n")
 }
 
 func NewConn(rw io.ReadWriter) *Conn {
+	// both settings start with initial values, and updated by
+	// SETTINGS Frame and its ACK only on this connection
 	conn := &Conn{
 		RW:           rw,
-		HpackContext: hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE)),
-		Settings:     DefaultSettings,
-		PeerSettings: DefaultSettings,
+		Settings:     DefaultSettings.Clone(),
+		PeerSettings: DefaultSettings.Clone(),
 		Window:       NewWindowDefault(),
 		Streams:      make(map[uint32]*Stream),
+		handlers:     make(map[uint32]struct{}),
 		WriteChan:    make(chan Frame),
+		closed:       make(chan struct{}),
+		pings:        make(map[[8]byte]chan struct{}),
+		lastRead:     time.Now(),
+		lastActive:   time.Now(),
+
+		closedStreams:        newClosedStreams(maxClosedStreams),
+		peerSettingsReceived: make(chan struct{}),
+
+		MaxHeaderBlockSize: DEFAULT_MAX_HEADER_BLOCK_SIZE,
 	}
+	// decoder table starts with SETTINGS_HEADER_TABLE_SIZE we send,
+	// and size update from peer is limited by conn, not by decoder,
+	// because the limit changes when new SETTINGS is acknowledged.
+	// encoder table starts with default until peer's one arrives.
+	conn.decoderTableSize = conn.Settings.HeaderTableSize()
+	conn.HpackDecoder = hpack.NewContext(MAX_HEADER_TABLE_SIZE)
+	conn.HpackDecoder.Decode(tableSizeUpdate(nil, conn.decoderTableSize))
+	conn.encoderTableSize = uint32(DEFAULT_HEADER_TABLE_SIZE)
+	conn.HpackEncoder = hpack.NewContext(conn.encoderTableSize)
 	return conn
 }
 
 func (conn *Conn) NewStream(streamid uint32) *Stream {
-	stream := NewStream(
-		streamid,
-		conn.WriteChan,
-		conn.Settings,
-		conn.PeerSettings,
-		conn.HpackContext,
-		conn.CallBack,
-	)
-	Debug("adding new stream (id=%d) total (%d)", stream.ID, len(conn.Streams))
+	stream := NewStream(conn, streamid, conn.CallBack)
 	return stream
 }
 
-func (conn *Conn) HandleSettings(settingsFrame *SettingsFrame) {
+// AddStream adds stream to Streams, or returns ErrConnClosed
+// after Close, which would never close the stream.
+func (conn *Conn) AddStream(stream *Stream) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.IsClosed() {
+		return ErrConnClosed
+	}
+	conn.Streams[stream.ID] = stream
+	if stream.CallBack != nil && !conn.isLocalStream(stream.ID) {
+		conn.handlers[stream.ID] = struct{}{}
+	}
+	conn.lastActive = time.Now()
+	if conn.isLocalStream(stream.ID) && stream.ID > conn.lastLocalStreamID {
+		conn.lastLocalStreamID = stream.ID
+	}
+	Debug("adding new stream (id=%d) total (%d)", stream.ID, len(conn.Streams))
+	return nil
+}
+
+func (conn *Conn) GetStream(streamID uint32) (stream *Stream, ok bool) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	stream, ok = conn.Streams[streamID]
+	return
+}
+
+// Setting returns our setting value of id
+func (conn *Conn) Setting(id SettingsID) int32 {
+	conn.settingsMu.Lock()
+	defer conn.settingsMu.Unlock()
+	return conn.Settings[id]
+}
+
+// PeerSetting returns peer's setting value of id
+func (conn *Conn) PeerSetting(id SettingsID) int32 {
+	conn.settingsMu.Lock()
+	defer conn.settingsMu.Unlock()
+	return conn.PeerSettings[id]
+}
+
+// LocalSettings returns copy of our settings acknowledged by peer
+func (conn *Conn) LocalSettings() Settings {
+	conn.settingsMu.Lock()
+	defer conn.settingsMu.Unlock()
+	return conn.Settings.Clone()
+}
+
+// RemoteSettings returns copy of peer's settings
+func (conn *Conn) RemoteSettings() Settings {
+	conn.settingsMu.Lock()
+	defer conn.settingsMu.Unlock()
+	return conn.PeerSettings.Clone()
+}
+
+// number of streams which is not closed or whose handler is running
+// odd for client initiated, even for server initiated (pushed)
+func (conn *Conn) ActiveStreams(odd bool) (n int32) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	for id, stream := range conn.Streams {
+		if (id%2 == 1) != odd {
+			continue
+		}
+		if stream.Active() {
+			n++
+		}
+	}
+	// stream reset by peer is still active until its handler returns
+	for id := range conn.handlers {
+		if (id%2 == 1) != odd {
+			continue
+		}
+		if stream, ok := conn.Streams[id]; !ok || !stream.Active() {
+			n++
+		}
+	}
+	return n
+}
+
+// handlerDone releases slot of stream held while its handler runs
+func (conn *Conn) handlerDone(stream *Stream) {
+	conn.mu.Lock()
+	delete(conn.handlers, stream.ID)
+	conn.mu.Unlock()
+}
+
+// NextStreamID allocates id of stream we initiate in order,
+// or returns ErrStreamIDExhausted over MAX_STREAM_ID.
+func (conn *Conn) NextStreamID() (uint32, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.nextStreamID == 0 {
+		conn.nextStreamID = 2
+		if conn.client {
+			conn.nextStreamID = 1
+		}
+	}
+	if conn.nextStreamID > MAX_STREAM_ID {
+		return 0, ErrStreamIDExhausted
+	}
+	streamID := conn.nextStreamID
+	conn.nextStreamID += 2
+	return streamID, nil
+}
+
+// StreamIDExhausted reports whether no more stream can be initiated
+func (conn *Conn) StreamIDExhausted() bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.nextStreamID > MAX_STREAM_ID
+}
+
+// CanTakeNewStream reports whether new stream can be opened
+// without exceeding peer's MAX_CONCURRENT_STREAMS
+// and connection is not closed, going away nor exhausted stream ids.
+func (conn *Conn) CanTakeNewStream() bool {
+	if conn.IsClosed() || conn.GoingAway() || conn.StreamIDExhausted() {
+		return false
+	}
+	conn.mu.Lock()
+	reserved := conn.reservedStreams
+	conn.mu.Unlock()
+	return conn.ActiveStreams(true)+reserved < conn.PeerSetting(SETTINGS_MAX_CONCURRENT_STREAMS)
+}
+
+// reserveStream reserves a slot of new stream under peer's MAX_CONCURRENT_STREAMS,
+// until releaseStream is called after the stream was added.
+// Transport calls it in lock, so that connection does not exceed it.
+func (conn *Conn) reserveStream() bool {
+	if !conn.CanTakeNewStream() {
+		return false
+	}
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.reservedStreams++
+	return true
+}
+
+func (conn *Conn) releaseStream() {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.reservedStreams--
+}
+
+// HandleSettings applies SETTINGS from peer and ACKs it,
+// or applies our pending SETTINGS by ACK.
+// error is connection error for GOAWAY.
+func (conn *Conn) HandleSettings(settingsFrame *SettingsFrame) *H2Error {
 	if settingsFrame.Flags == ACK {
 		// receive ACK
 		Trace("receive SETTINGS ACK")
-		return
+		conn.applySettings()
+		return nil
 	}
 
 	if settingsFrame.Flags != UNSET {
 		Error("unknown flag of SETTINGS Frame %v", settingsFrame.Flags)
-		return
+		return nil
 	}
 
 	// received SETTINGS Frame
-	settings := settingsFrame.Settings
+	settings := Settings(settingsFrame.Settings)
 
-	defaultSettings := map[SettingsID]int32{
-		SETTINGS_HEADER_TABLE_SIZE:      DEFAULT_HEADER_TABLE_SIZE,
-		SETTINGS_ENABLE_PUSH:            DEFAULT_ENABLE_PUSH,
-		SETTINGS_MAX_CONCURRENT_STREAMS: DEFAULT_MAX_CONCURRENT_STREAMS,
-		SETTINGS_INITIAL_WINDOW_SIZE:    DEFAULT_INITIAL_WINDOW_SIZE,
-		SETTINGS_MAX_FRAME_SIZE:         DEFAULT_MAX_FRAME_SIZE,
-		SETTINGS_MAX_HEADER_LIST_SIZE:   DEFAULT_MAX_HEADER_LIST_SIZE,
+	Trace("peer settigns ============")
+	for k, v := range settings {
+		Trace("%v:%v", k, v)
 	}
+	Trace("peer settigns ============")
 
-	// merge with default
-	for k, v := range settings {
-		defaultSettings[k] = v
+	// invalid value is connection error, and not acknowledged
+	if h2Error := settings.Validate(); h2Error != nil {
+		Error("%v", h2Error)
+		return h2Error
 	}
 
-	Trace("merged settigns ============")
-	for k, v := range defaultSettings {
-		Trace("%v:%v", k, v)
+	// encoder and WriteChan are not used in lock of settings,
+	// because header block is written with reading PeerSettings
+	conn.settingsMu.Lock()
+
+	// settings from peer are saved to PeerSettings,
+	// Settings we advertised (e.g. MAX_CONCURRENT_STREAMS) are kept
+	for id, value := range settings {
+		// unsigned values over 2^31-1 are treated as 2^31-1
+		if value < 0 {
+			value = 1<<31 - 1
+		}
+		conn.PeerSettings[id] = value
+	}
+
+	// SETTINGS_INITIAL_WINDOW_SIZE changes window of all streams we send
+	if _, ok := settings[SETTINGS_INITIAL_WINDOW_SIZE]; ok {
+		conn.mu.Lock()
+		for _, stream := range conn.Streams {
+			Debug("apply settings to stream(%d)", stream.ID)
+			stream.Window.UpdateInitialSize(settings.InitialWindowSize())
+		}
+		conn.mu.Unlock()
 	}
-	Trace("merged settigns ============")
 
-	// save settings to conn
-	conn.Settings = defaultSettings
+	conn.settingsMu.Unlock()
+
+	// SETTINGS_HEADER_TABLE_SIZE
+	if _, ok := settings[SETTINGS_HEADER_TABLE_SIZE]; ok {
+		conn.UpdateEncoderTableSize(settings.HeaderTableSize())
+	}
+
+	// send ACK
+	ack := NewSettingsFrame(ACK, 0, NilSettings)
+	conn.Write(ack)
+
+	if !conn.settingsReceived {
+		conn.settingsReceived = true
+		close(conn.peerSettingsReceived)
+	}
+	return nil
+}
+
+type pendingSettings struct {
+	settings Settings
+	timer    *time.Timer // for SettingsTimeout
+}
 
-	// SETTINGS_INITIAL_WINDOW_SIZE
-	initialWindowSize, ok := settings[SETTINGS_INITIAL_WINDOW_SIZE]
+// SendSettings sends SETTINGS to peer, which can be called
+// at any time to change our settings (e.g. SETTINGS_INITIAL_WINDOW_SIZE).
+// settings are pending until ACK arrives, and then applied to Settings.
+// if ACK doesn't come in SettingsTimeout, connection is closed
+// with GOAWAY SETTINGS_TIMEOUT.
+// invalid settings are not sent and returns error.
+func (conn *Conn) SendSettings(settings Settings) error {
+	if h2Error := settings.Validate(); h2Error != nil {
+		return h2Error
+	}
+	pending := &pendingSettings{
+		settings: settings.Clone(),
+	}
+
+	// pending is queued before sending, so that ACK finds it
+	conn.settingsMu.Lock()
+	conn.pendingSettings = append(conn.pendingSettings, pending)
+	if conn.SettingsTimeout > 0 {
+		pending.timer = time.AfterFunc(conn.SettingsTimeout, conn.settingsTimeout)
+	}
+	conn.settingsMu.Unlock()
+
+	conn.Write(NewSettingsFrame(UNSET, 0, pending.settings))
+	return nil
+}
+
+// settingsTimeout closes connection because peer didn't ACK SETTINGS
+func (conn *Conn) settingsTimeout() {
+	Error("SETTINGS ACK didn't come in %v", conn.SettingsTimeout)
+	conn.goAwayAndWait(&H2Error{SETTINGS_TIMEOUT, "SETTINGS ACK timeout"})
+	conn.closeRW()
+}
+
+// applySettings applies the oldest pending SETTINGS
+// acknowledged by peer. limits we advertised
+// (e.g. MAX_CONCURRENT_STREAMS, MAX_FRAME_SIZE) are enforced after it.
+// HEADER_TABLE_SIZE limits size update from peer's encoder after it,
+// and the change is signaled by peer in next header block.
+func (conn *Conn) applySettings() {
+	conn.settingsMu.Lock()
+	defer conn.settingsMu.Unlock()
+
+	if len(conn.pendingSettings) == 0 {
+		Error("SETTINGS ACK without pending SETTINGS")
+		return
+	}
+	pending := conn.pendingSettings[0]
+	conn.pendingSettings = conn.pendingSettings[1:]
+	if pending.timer != nil {
+		pending.timer.Stop()
+	}
+
+	Debug("apply settings %v", pending.settings)
+	conn.Settings.Merge(pending.settings)
+
+	if _, ok := pending.settings[SETTINGS_HEADER_TABLE_SIZE]; ok {
+		conn.decoderTableSize = conn.Settings.HeaderTableSize()
+	}
+
+	// SETTINGS_INITIAL_WINDOW_SIZE changes window of
+	// all streams we receive, peer did it when it received SETTINGS
+	initialWindowSize, ok := pending.settings[SETTINGS_INITIAL_WINDOW_SIZE]
 	if ok {
+		conn.mu.Lock()
+		for _, stream := range conn.Streams {
+			stream.Window.UpdateLocalInitialSize(initialWindowSize)
+		}
+		conn.mu.Unlock()
+	}
+}
 
-		if initialWindowSize > 2147483647 { // validate < 2^31-1
-			Error("FLOW_CONTROL_ERROR (%s)", "SETTINGS_INITIAL_WINDOW_SIZE too large")
-			return
+// windowAllowance is increase of SETTINGS_INITIAL_WINDOW_SIZE
+// we sent but not acknowledged yet, which peer may already use.
+func (conn *Conn) windowAllowance() (allowance int32) {
+	conn.settingsMu.Lock()
+	defer conn.settingsMu.Unlock()
+
+	current := conn.Settings.InitialWindowSize()
+	for _, pending := range conn.pendingSettings {
+		size, ok := pending.settings[SETTINGS_INITIAL_WINDOW_SIZE]
+		if ok && size-current > allowance {
+			allowance = size - current
 		}
+	}
+	return allowance
+}
 
-		conn.PeerSettings[SETTINGS_INITIAL_WINDOW_SIZE] = initialWindowSize
+// PeerSettingsReceived is closed when the first SETTINGS
+// from peer was applied, so that limits of peer are known.
+func (conn *Conn) PeerSettingsReceived() <-chan struct{} {
+	return conn.peerSettingsReceived
+}
 
-		for _, stream := range conn.Streams {
-			log.Println("apply settings to stream", stream)
-			stream.Window.UpdateInitialSize(initialWindowSize)
-			stream.PeerSettings[SETTINGS_INITIAL_WINDOW_SIZE] = initialWindowSize
+// ReadHeaderBlock buffers header block fragments of
+// HEADERS/PUSH_PROMISE and CONTINUATION Frames until END_HEADERS,
+// and decode whole block at once.
+// it returns frame which has decoded headers with END_HEADERS,
+// or nil if header block continues.
+// other frames are returned as is.
+func (conn *Conn) ReadHeaderBlock(frame Frame) (Frame, error) {
+	header := frame.Header()
+
+	if conn.HeaderBlock != nil {
+		// header block must be followed only by CONTINUATION
+		// on the same stream (RFC 7540 6.10)
+		streamID := conn.HeaderBlock.Header().StreamID
+		if header.Type != ContinuationFrameType || header.StreamID != streamID {
+			msg := fmt.Sprintf("%v FRAME on stream(%d) while receiving header block on stream(%d)", header.Type, header.StreamID, streamID)
+			return nil, &H2Error{PROTOCOL_ERROR, msg}
+		}
+
+		continuation := frame.(*ContinuationFrame)
+		err := conn.bufferHeaderBlock(continuation.HeaderBlockFragment)
+		if err != nil {
+			return nil, err
+		}
+
+		if header.Flags&END_HEADERS != END_HEADERS {
+			return nil, nil
+		}
+
+		// header block completed
+		frame = conn.HeaderBlock
+		frame.Header().Flags |= END_HEADERS
+		switch f := frame.(type) {
+		case *HeadersFrame:
+			f.HeaderBlockFragment = conn.HeaderBlockBuffer
+		case *PushPromiseFrame:
+			f.HeaderBlockFragment = conn.HeaderBlockBuffer
+		}
+		conn.HeaderBlock = nil
+		conn.HeaderBlockBuffer = nil
+	} else {
+		switch f := frame.(type) {
+		case *ContinuationFrame:
+			msg := fmt.Sprintf("CONTINUATION FRAME on stream(%d) without HEADERS", header.StreamID)
+			return nil, &H2Error{PROTOCOL_ERROR, msg}
+		case *HeadersFrame:
+			if header.Flags&END_HEADERS != END_HEADERS {
+				conn.HeaderBlock = frame
+				conn.headerBlockStart = time.Now()
+				return nil, conn.bufferHeaderBlock(f.HeaderBlockFragment)
+			}
+		case *PushPromiseFrame:
+			if header.Flags&END_HEADERS != END_HEADERS {
+				conn.HeaderBlock = frame
+				conn.headerBlockStart = time.Now()
+				return nil, conn.bufferHeaderBlock(f.HeaderBlockFragment)
+			}
+		default:
+			return frame, nil
 		}
 	}
 
-	// send ACK
-	ack := NewSettingsFrame(ACK, 0, NilSettings)
-	conn.WriteChan <- ack
+	// decode whole header block in order of receiving
+	// failure of decoding breaks HPACK context of connection
+	// so it is COMPRESSION_ERROR for connection (RFC 7540 4.3)
+	var err error
+	switch f := frame.(type) {
+	case *HeadersFrame:
+		f.Headers, err = conn.DecodeHeader(f.HeaderBlockFragment)
+	case *PushPromiseFrame:
+		f.Headers, err = conn.DecodeHeader(f.HeaderBlockFragment)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return frame, nil
+}
+
+func (conn *Conn) bufferHeaderBlock(fragment []byte) error {
+	if len(conn.HeaderBlockBuffer)+len(fragment) > conn.MaxHeaderBlockSize {
+		msg := fmt.Sprintf("header block is larger than %d", conn.MaxHeaderBlockSize)
+		return &H2Error{ENHANCE_YOUR_CALM, msg}
+	}
+	conn.HeaderBlockBuffer = append(conn.HeaderBlockBuffer, fragment...)
+	return nil
+}
+
+// Decode Header using HPACK decoder context.
+// hpack panics with malformed header block,
+// it is returned as COMPRESSION_ERROR.
+func (conn *Conn) DecodeHeader(headerBlock []byte) (header http.Header, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			msg := fmt.Sprintf("failed to decode header block: %v", r)
+			header, err = nil, &H2Error{COMPRESSION_ERROR, msg}
+		}
+	}()
+	if h2Error := conn.checkTableSizeUpdate(headerBlock); h2Error != nil {
+		return nil, h2Error
+	}
+	conn.HpackDecoder.Decode(headerBlock)
+	return conn.HpackDecoder.ES.ToHeader(), nil
+}
+
+// checkTableSizeUpdate checks Dynamic Table Size Updates in header block,
+// which are allowed only at the beginning of it and should not exceed
+// SETTINGS_HEADER_TABLE_SIZE we advertised (RFC 7541 4.2).
+// other representations are skipped without decoding.
+func (conn *Conn) checkTableSizeUpdate(block []byte) *H2Error {
+	field := false // header field appeared
+	for len(block) > 0 {
+		var n int
+		switch b := block[0]; {
+		case b&0x80 == 0x80:
+			// Indexed Header Field
+			_, n = readInteger(block, 7)
+			field = true
+		case b&0xe0 == 0x20:
+			// Dynamic Table Size Update
+			if field {
+				return &H2Error{COMPRESSION_ERROR, "dynamic table size update after header field"}
+			}
+			var size uint64
+			size, n = readInteger(block, 5)
+			if n > 0 && size > uint64(conn.decoderTableSize) {
+				msg := fmt.Sprintf("dynamic table size update %d over %d", size, conn.decoderTableSize)
+				return &H2Error{COMPRESSION_ERROR, msg}
+			}
+		case b&0xc0 == 0x40:
+			// Literal Header Field with Incremental Indexing
+			n = skipLiteral(block, 6)
+			field = true
+		default:
+			// Literal Header Field without Indexing or Never Indexed
+			n = skipLiteral(block, 4)
+			field = true
+		}
+		if n == 0 {
+			return &H2Error{COMPRESSION_ERROR, "invalid header block"}
+		}
+		block = block[n:]
+	}
+	return nil
+}
+
+// Encode Header using HPACK encoder context.
+// caller should hold conn.headerMu.
+func (conn *Conn) EncodeHeader(header http.Header) []byte {
+	headerList := hpack.ToHeaderList(header)
+	Trace("sending header list %s", headerList)
+	block := conn.HpackEncoder.Encode(*headerList)
+
+	if conn.tableSizeUpdate {
+		conn.tableSizeUpdate = false
+		// new encoder has empty table, so evict all entries of
+		// peer's table with size 0, then set new size (RFC 7541 4.2)
+		update := tableSizeUpdate(nil, 0)
+		update = tableSizeUpdate(update, conn.encoderTableSize)
+		block = append(update, block...)
+	}
+	return block
+}
+
+// UpdateEncoderTableSize changes dynamic table size of encoder
+// to peer's SETTINGS_HEADER_TABLE_SIZE.
+func (conn *Conn) UpdateEncoderTableSize(size uint32) {
+	conn.headerMu.Lock()
+	defer conn.headerMu.Unlock()
+
+	if size == conn.encoderTableSize {
+		return
+	}
+	Debug("encoder table size %d => %d", conn.encoderTableSize, size)
+	conn.HpackEncoder = hpack.NewContext(size)
+	conn.encoderTableSize = size
+	conn.tableSizeUpdate = true
+}
+
+// Dynamic Table Size Update (RFC 7541 6.3)
+// size is 5 bit prefix integer with 001 pattern
+func tableSizeUpdate(b []byte, size uint32) []byte {
+	const max = 1<<5 - 1
+	if size < max {
+		return append(b, 0x20|byte(size))
+	}
+	b = append(b, 0x20|max)
+	size -= max
+	for size >= 128 {
+		b = append(b, byte(size%128+128))
+		size /= 128
+	}
+	return append(b, byte(size))
+}
+
+// readInteger returns integer with prefix bits (RFC 7541 5.1)
+// and its length, or 0 length if it is truncated or too large.
+func readInteger(b []byte, prefix uint) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	max := uint64(1)<<prefix - 1
+	value := uint64(b[0]) & max
+	if value < max {
+		return value, 1
+	}
+	for i, shift := 1, uint(0); i < len(b) && shift < 32; i, shift = i+1, shift+7 {
+		value += uint64(b[i]&127) << shift
+		if b[i]&128 == 0 {
+			return value, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// skipLiteral returns length of Literal Header Field
+// with index of prefix bits, or 0 if it is truncated.
+func skipLiteral(b []byte, prefix uint) int {
+	index, n := readInteger(b, prefix)
+	if n == 0 {
+		return 0
+	}
+	// new name follows if index is 0
+	if index == 0 {
+		m := skipString(b[n:])
+		if m == 0 {
+			return 0
+		}
+		n += m
+	}
+	m := skipString(b[n:])
+	if m == 0 {
+		return 0
+	}
+	return n + m
+}
+
+// skipString returns length of String Literal, or 0 if it is truncated
+func skipString(b []byte) int {
+	length, n := readInteger(b, 7)
+	if n == 0 || uint64(len(b)-n) < length {
+		return 0
+	}
+	return n + int(length)
 }
 
 func (conn *Conn) ReadLoop() {
 	Debug("start conn.ReadLoop()")
+	if conn.IdleTimeout > 0 {
+		go conn.closeIdle()
+	}
+	conn.budgets = newBudgets(conn.Limits)
 	for {
 		// コネクションからフレームを読み込む
+		// Settings is changed only in this goroutine
+		timeoutError := conn.setReadDeadline()
 		frame, err := ReadFrame(conn.RW, conn.Settings)
 		if err != nil {
 			Error("%v", err)
+			if netError, ok := err.(net.Error); ok && netError.Timeout() && timeoutError != nil {
+				conn.goAwayAndWait(timeoutError)
+				break
+			}
 			h2Error, ok := err.(*H2Error)
 			if ok {
-				conn.GoAway(0, h2Error)
+				conn.goAwayAndWait(h2Error)
 			}
 			break
 		}
@@ -131,6 +802,31 @@ func (conn *Conn) ReadLoop() {
 			Notice("%v %v", Green("recv"), util.Indent(frame.String()))
 		}
 
+		conn.mu.Lock()
+		conn.lastRead = time.Now()
+		conn.mu.Unlock()
+
+		// peer flooding frames which make no progress is closed
+		if h2Error := conn.budgets.spend(frame); h2Error != nil {
+			conn.goAwayAndWait(h2Error)
+			break
+		}
+
+		// HEADERS/PUSH_PROMISE と CONTINUATION を
+		// END_HEADERS まで集めてからまとめて扱う
+		frame, err = conn.ReadHeaderBlock(frame)
+		if err != nil {
+			Error("%v", err)
+			h2Error, ok := err.(*H2Error)
+			if ok {
+				conn.goAwayAndWait(h2Error)
+			}
+			break
+		}
+		if frame == nil {
+			continue
+		}
+
 		streamID := frame.Header().StreamID
 		types := frame.Header().Type
 
@@ -145,8 +841,8 @@ func (conn *Conn) ReadLoop() {
 
 				msg := fmt.Sprintf("%s FRAME for Stream ID 0", types)
 				Error("%v", msg)
-				conn.GoAway(0, &H2Error{PROTOCOL_ERROR, msg})
-				break // TODO: check this flow is correct or not
+				conn.goAwayAndWait(&H2Error{PROTOCOL_ERROR, msg})
+				break
 			}
 
 			// SETTINGS frame を受け取った場合
@@ -156,7 +852,10 @@ func (conn *Conn) ReadLoop() {
 					Error("invalid settings frame %v", frame)
 					return
 				}
-				conn.HandleSettings(settingsFrame)
+				if h2Error := conn.HandleSettings(settingsFrame); h2Error != nil {
+					conn.goAwayAndWait(h2Error)
+					break
+				}
 			}
 
 			// Connection Level Window Update
@@ -170,19 +869,22 @@ func (conn *Conn) ReadLoop() {
 				conn.Window.UpdatePeer(int32(windowUpdateFrame.WindowSizeIncrement))
 			}
 
-			// respond to PING
+			// respond to PING with the same opaque data
 			if types == PingFrameType {
-				// ignore ack
-				if frame.Header().Flags != ACK {
-					conn.PingACK([]byte("pong    ")) // should be 8 byte
+				pingFrame := frame.(*PingFrame)
+				if pingFrame.Flags == ACK {
+					conn.pingACKReceived(pingFrame.OpaqueData)
+				} else {
+					conn.PingACK(pingFrame.OpaqueData)
 				}
 				continue
 			}
 
-			// handle GOAWAY with close connection
+			// streams under last stream id of GOAWAY continue
+			// until finished, or peer closes connection
 			if types == GoAwayFrameType {
-				Debug("stop conn.ReadLoop() by GOAWAY")
-				break
+				conn.HandleGoAway(frame.(*GoAwayFrame))
+				continue
 			}
 		}
 
@@ -194,87 +896,755 @@ func (conn *Conn) ReadLoop() {
 
 				msg := fmt.Sprintf("%s FRAME for Stream ID not 0", types)
 				Error("%v", msg)
-				conn.GoAway(0, &H2Error{PROTOCOL_ERROR, msg})
-				break // TODO: check this flow is correct or not
+				conn.goAwayAndWait(&H2Error{PROTOCOL_ERROR, msg})
+				break
 			}
 
-			// DATA frame なら winodw を消費
-			if types == DataFrameType {
-				length := int32(frame.Header().Length)
-				conn.WindowConsume(length)
+			// DATA frame の window は body が読まれた時に消費する
+			// but it is counted against connection window we advertised
+			// when received, whether its stream is alive or not
+			if types == DataFrameType && !conn.Window.Receive(int32(frame.Header().Length), 0) {
+				msg := fmt.Sprintf("DATA FRAME on stream(%d) over connection window", streamID)
+				Error("%v", msg)
+				conn.goAwayAndWait(&H2Error{FLOW_CONTROL_ERROR, msg})
+				break
 			}
 
 			// 新しいストリーム ID なら対応するストリームを生成
-			stream, ok := conn.Streams[streamID]
+			stream, ok := conn.GetStream(streamID)
+			refused := false
+			if !ok && conn.ignoreNewStream(streamID) {
+				// streams after final GOAWAY are ignored,
+				// but DATA Frame consumes connection window
+				Debug("ignore %v frame for stream(%d) after GOAWAY", types, streamID)
+				if types == DataFrameType {
+					conn.WindowConsume(int32(frame.Header().Length))
+				}
+				continue
+			}
 			if !ok {
+				open, err := conn.checkNewStream(frame)
+				if !open && types == DataFrameType {
+					// DATA Frame for closed stream consumes connection window
+					conn.WindowConsume(int32(frame.Header().Length))
+				}
+				if streamError, ok := err.(*StreamError); ok {
+					// frame for closed stream
+					Error("%v", streamError)
+					conn.Write(NewRstStreamFrame(streamID, streamError.ErrorCode))
+					continue
+				}
+				if h2Error, ok := err.(*H2Error); ok {
+					Error("%v", h2Error)
+					conn.goAwayAndWait(h2Error)
+					break
+				}
+				if !open {
+					Debug("ignore %v frame for stream(%d)", types, streamID)
+					continue
+				}
+
+				// client initiated stream over SETTINGS_MAX_CONCURRENT_STREAMS
+				// we advertised is refused after its state changed
+				refused = conn.ActiveStreams(true) >= conn.Setting(SETTINGS_MAX_CONCURRENT_STREAMS)
+
 				// create stream with streamID
 				stream = conn.NewStream(streamID)
-				conn.Streams[streamID] = stream
+				if err := conn.AddStream(stream); err != nil {
+					stream.Close()
+					break
+				}
 
 				// update last stream id
+				conn.mu.Lock()
 				if streamID > conn.LastStreamID {
 					conn.LastStreamID = streamID
 				}
+				conn.mu.Unlock()
+			}
+
+			// frames for stream we have reset are ignored,
+			// but DATA Frame consumes connection window
+			if stream.IsClosed() {
+				Debug("ignore %v frame for closed stream(%d)", types, streamID)
+				if types == DataFrameType {
+					conn.WindowConsume(int32(frame.Header().Length))
+				}
+				continue
 			}
 
 			// stream の state を変える
+			// stream error resets only the stream,
+			// connection error closes connection with GOAWAY
 			err = stream.ChangeState(frame, RECV)
+			if err == nil {
+				if streamError := stream.checkReceiveWindow(frame); streamError != nil {
+					err = streamError
+				}
+			}
+			if err == nil {
+				if streamError := stream.checkContentLength(frame); streamError != nil {
+					err = streamError
+				}
+			}
 			if err != nil {
+				if streamError, ok := err.(*StreamError); ok {
+					if types == DataFrameType {
+						conn.WindowConsume(int32(frame.Header().Length))
+					}
+					conn.ResetStream(stream, streamError)
+					continue
+				}
 				Error("%v", err)
 				h2Error, ok := err.(*H2Error)
 				if ok {
-					conn.GoAway(0, h2Error)
+					conn.goAwayAndWait(h2Error)
 				}
 				break
 			}
 
+			// PUSH_PROMISE reserves promised stream
+			// before following frames for it are read
+			if types == PushPromiseFrameType {
+				if h2Error := conn.checkPushPromise(frame.(*PushPromiseFrame)); h2Error != nil {
+					Error("%v", h2Error)
+					conn.goAwayAndWait(h2Error)
+					break
+				}
+				conn.ReadPushPromise(frame.(*PushPromiseFrame))
+			}
+
+			if refused {
+				msg := "over SETTINGS_MAX_CONCURRENT_STREAMS"
+				conn.ResetStream(stream, &StreamError{streamID, REFUSED_STREAM, msg})
+				continue
+			}
+
 			// stream が close ならリストから消す
-			if stream.State == CLOSED {
-
-				// ただし、1 秒は window update が来てもいいように待つ
-				// TODO: atomic にする
-				go func(streamID uint32) {
-					<-time.After(1 * time.Second)
-					Info("remove stream(%d) from conn.Streams[]", streamID)
-					conn.Streams[streamID] = nil
-				}(streamID)
+			if stream.GetState() == CLOSED {
+				reason := closedByEndStream
+				if types == RstStreamFrameType {
+					reason = closedByResetReceived
+				}
+				conn.closeStream(stream, reason)
 			}
 
 			// ストリームにフレームを渡す
-			stream.ReadChan <- frame
+			stream.Deliver(frame)
 		}
 	}
 
 	Debug("stop the readloop")
 }
 
+// WriteLoop is the only goroutine which writes to connection,
+// it writes frames passed to WriteChan until connection is closed.
+// if writing fails, connection is closed.
 func (conn *Conn) WriteLoop() (err error) {
 	Debug("start conn.WriteLoop()")
-	for frame := range conn.WriteChan {
-		Notice("%v %v", Red("send"), util.Indent(frame.String()))
+	for {
+		select {
+		case frame := <-conn.WriteChan:
+			Notice("%v %v", Red("send"), util.Indent(frame.String()))
 
-		// TODO: ここで connection レベルの WindowSize を見る
-		err = frame.Write(conn.RW)
-		if err != nil {
-			Error("%v", err)
-			return err
+			if rw, ok := conn.RW.(deadliner); ok && conn.WriteTimeout > 0 {
+				rw.SetWriteDeadline(time.Now().Add(conn.WriteTimeout))
+			}
+
+			// DATA Frame is already charged against stream and
+			// connection window in ReserveWindow, so it is written as is
+			err = frame.Write(conn.RW)
+			if err != nil {
+				// connection is broken or peer doesn't read in WriteTimeout
+				Error("%v", err)
+				conn.closeRW()
+				return err
+			}
+		case <-conn.closed:
+			Debug("stop conn.WriteLoop()")
+			return nil
 		}
 	}
-	return
+}
+
+// Write passes frame to WriteLoop.
+// frame is dropped if connection was closed.
+func (conn *Conn) Write(frame Frame) {
+	select {
+	case conn.WriteChan <- frame:
+	case <-conn.closed:
+		Debug("drop %v frame for closed connection", frame.Header().Type)
+	}
+}
+
+// WriteAndWait passes frame to WriteLoop and
+// waits until it was written to connection.
+func (conn *Conn) WriteAndWait(frame Frame) error {
+	written := writtenFrame{frame, make(chan error, 1)}
+	conn.Write(written)
+	select {
+	case err := <-written.err:
+		return err
+	case <-conn.closed:
+		return fmt.Errorf("connection was closed")
+	}
+}
+
+// writtenFrame notifies result of Write
+type writtenFrame struct {
+	Frame
+	err chan error
+}
+
+func (f writtenFrame) Write(w io.Writer) error {
+	err := f.Frame.Write(w)
+	f.err <- err
+	return err
 }
 
 func (conn *Conn) PingACK(opaqueData []byte) {
 	Debug("Ping ACK with opaque(%v)", opaqueData)
 	pingAck := NewPingFrame(ACK, 0, opaqueData)
-	conn.WriteChan <- pingAck
+	conn.Write(pingAck)
+}
+
+// Ping sends PING with unique opaque data and waits its ACK.
+// it returns round trip time, or error when ctx is done
+// or connection is closed before ACK.
+func (conn *Conn) Ping(ctx context.Context) (time.Duration, error) {
+	var opaqueData [8]byte
+	_, err := rand.Read(opaqueData[:])
+	if err != nil {
+		return 0, err
+	}
+
+	ack := make(chan struct{})
+	conn.mu.Lock()
+	conn.pings[opaqueData] = ack
+	conn.mu.Unlock()
+
+	defer func() {
+		conn.mu.Lock()
+		delete(conn.pings, opaqueData)
+		conn.mu.Unlock()
+	}()
+
+	start := time.Now()
+	conn.Write(NewPingFrame(UNSET, 0, opaqueData[:]))
+
+	select {
+	case <-ack:
+		rtt := time.Since(start)
+		Debug("PING rtt(%v)", rtt)
+		return rtt, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-conn.closed:
+		return 0, fmt.Errorf("connection was closed")
+	}
+}
+
+// time to wait PING ACK of keepalive if not specified
+var defaultPingTimeout = 15 * time.Second
+
+// KeepAlive sends PING when no frame is received for interval,
+// and closes connection if ACK does not come back within timeout.
+// connection silently dropped on the way (e.g. by load balancer)
+// is detected by it. it returns when connection is closed.
+func (conn *Conn) KeepAlive(interval, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = defaultPingTimeout
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-conn.closed:
+			return
+		}
+
+		conn.mu.Lock()
+		idle := time.Since(conn.lastRead)
+		conn.mu.Unlock()
+		if idle < interval {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		_, err := conn.Ping(ctx)
+		cancel()
+		if err != nil {
+			Error("keepalive PING failed (%v), close connection", err)
+			conn.closeRW()
+			return
+		}
+	}
+}
+
+func (conn *Conn) pingACKReceived(opaqueData []byte) {
+	var key [8]byte
+	copy(key[:], opaqueData)
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	ack, ok := conn.pings[key]
+	if !ok {
+		Debug("PING ACK for unknown opaque(%v)", opaqueData)
+		return
+	}
+	delete(conn.pings, key)
+	close(ack)
+}
+
+// GoAwayError is reason of closing stream initiated by us,
+// which has larger id than last stream id of GOAWAY.
+// the stream was not processed by peer, so it can be retried.
+type GoAwayError struct {
+	LastStreamID uint32
+	ErrorCode    ErrorCode
+	DebugData    string
+}
+
+func (e *GoAwayError) Error() string {
+	return fmt.Sprintf("GOAWAY received (last_stream_id=%d, error_code=%v, debug_data=%q)", e.LastStreamID, e.ErrorCode, e.DebugData)
+}
+
+// HandleGoAway marks connection unusable for new streams,
+// and fails streams initiated by us over last stream id with GoAwayError.
+// streams under it continue until finished.
+func (conn *Conn) HandleGoAway(frame *GoAwayFrame) {
+	conn.mu.Lock()
+
+	// last stream id never increases, but keep smaller one
+	lastStreamID := frame.LastStreamID
+	if conn.GoAwayReceived && conn.GoAwayLastStreamID < lastStreamID {
+		lastStreamID = conn.GoAwayLastStreamID
+	}
+	conn.GoAwayReceived = true
+	conn.GoAwayLastStreamID = lastStreamID
+	conn.GoAwayErrorCode = frame.ErrorCode
+
+	err := &GoAwayError{lastStreamID, frame.ErrorCode, string(frame.AdditionalDebugData)}
+	if frame.ErrorCode == NO_ERROR {
+		Info("%v", err)
+	} else {
+		Error("%v", err)
+	}
+
+	unprocessed := make([]*Stream, 0)
+	for id, stream := range conn.Streams {
+		if conn.isLocalStream(id) && id > lastStreamID {
+			unprocessed = append(unprocessed, stream)
+		}
+	}
+	conn.mu.Unlock()
+
+	// unprocessed streams are removed from connection,
+	// so that they are not counted as active
+	for _, stream := range unprocessed {
+		stream.Reset(err)
+		conn.closeStream(stream, closedByGoAway)
+	}
+}
+
+// CheckGoAway returns GoAwayError if stream initiated by us
+// will not be processed because of GOAWAY from peer.
+// it is checked after the stream was added to Streams,
+// otherwise HandleGoAway fails the stream.
+func (conn *Conn) CheckGoAway(streamID uint32) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.GoAwayReceived && streamID > conn.GoAwayLastStreamID {
+		return &GoAwayError{conn.GoAwayLastStreamID, conn.GoAwayErrorCode, ""}
+	}
+	return nil
+}
+
+// GoingAway reports whether GOAWAY was received
+func (conn *Conn) GoingAway() bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.GoAwayReceived
+}
+
+func (conn *Conn) isLocalStream(streamID uint32) bool {
+	return (streamID%2 == 1) == conn.client
+}
+
+// streams initiated by peer after final GOAWAY are ignored
+func (conn *Conn) ignoreNewStream(streamID uint32) bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.GoAwaySent && streamID > conn.LastStreamID
+}
+
+// interval to check streams finished in Shutdown
+var shutdownPollInterval = 100 * time.Millisecond
+
+// time to wait PING ACK in Shutdown, the final GOAWAY is sent
+// without it if peer doesn't respond.
+var shutdownPingTimeout = time.Second
+
+// Shutdown closes connection gracefully with two GOAWAY Frames.
+// the first GOAWAY with max stream id tells peer to stop opening streams,
+// and PING round trip ensures peer received it, so that streams
+// opened before it arrived are counted in the final GOAWAY
+// with last stream id actually processed.
+// ACK is waited at most shutdownPingTimeout.
+// then it waits for streams to finish until ctx is done,
+// and closes connection.
+func (conn *Conn) Shutdown(ctx context.Context) error {
+	Info("shutdown connection")
+	conn.Write(NewGoAwayFrame(0, MAX_STREAM_ID, NO_ERROR, nil))
+
+	pingCtx, cancel := context.WithTimeout(ctx, shutdownPingTimeout)
+	_, err := conn.Ping(pingCtx)
+	cancel()
+	if err != nil {
+		Error("%v", err)
+	}
+
+	conn.mu.Lock()
+	conn.GoAwaySent = true
+	lastStreamID := conn.LastStreamID
+	conn.mu.Unlock()
+
+	err = conn.WriteAndWait(NewGoAwayFrame(0, lastStreamID, NO_ERROR, nil))
+	if err != nil {
+		Error("%v", err)
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if conn.ActiveStreams(true)+conn.ActiveStreams(false) == 0 {
+			break
+		}
+		select {
+		case <-ticker.C:
+		case <-conn.closed:
+			return nil
+		case <-ctx.Done():
+			Info("close connection with active streams")
+			conn.closeRW()
+			return ctx.Err()
+		}
+	}
+
+	conn.closeRW()
+	return nil
+}
+
+// close underlying connection if it can,
+// it stops ReadLoop with error.
+func (conn *Conn) closeRW() {
+	conn.Close()
+	if closer, ok := conn.RW.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// checkNewStream validates id of stream which is not in Streams (RFC 7540 5.1.1).
+// it returns true if frame opens new stream from peer.
+// frame for closed stream is StreamError (STREAM_CLOSED) or ignored,
+// and frame for idle stream or invalid id is connection error.
+func (conn *Conn) checkNewStream(frame Frame) (bool, error) {
+	header := frame.Header()
+	streamID := header.StreamID
+	types := header.Type
+
+	conn.mu.Lock()
+	lastStreamID := conn.LastStreamID
+	lastLocalStreamID := conn.lastLocalStreamID
+	conn.mu.Unlock()
+
+	// PRIORITY can be sent for stream in any state
+	if types == PriorityFrameType {
+		return false, nil
+	}
+
+	// recently closed stream is handled by reason of close (RFC 7540 5.1)
+	if reason, ok := conn.closedReason(streamID); ok {
+		switch {
+		case types == WindowUpdateFrameType, types == RstStreamFrameType:
+			// peer may send them before it knows stream was closed
+			return false, nil
+		case reason == closedByResetSent:
+			// frames sent before peer received our RST_STREAM
+			return false, nil
+		case reason == closedByGoAway:
+			// peer didn't process it, nothing should come
+			return false, nil
+		}
+		msg := fmt.Sprintf("%v FRAME for closed stream", types)
+		return false, &StreamError{streamID, STREAM_CLOSED, msg}
+	}
+
+	local := conn.isLocalStream(streamID)
+
+	// streams under the largest id are closed,
+	// removed from Streams or skipped by peer
+	if local && streamID <= lastLocalStreamID || !local && streamID <= lastStreamID {
+		switch types {
+		case WindowUpdateFrameType, RstStreamFrameType:
+			// peer may send them before it knows stream was closed
+			return false, nil
+		case HeadersFrameType:
+			if !local {
+				msg := fmt.Sprintf("new stream(%d) is not greater than last stream(%d)", streamID, lastStreamID)
+				return false, &H2Error{PROTOCOL_ERROR, msg}
+			}
+		}
+		msg := fmt.Sprintf("%v FRAME for closed stream", types)
+		return false, &StreamError{streamID, STREAM_CLOSED, msg}
+	}
+
+	// idle stream is opened only by HEADERS from client,
+	// server opens stream by PUSH_PROMISE
+	if types == HeadersFrameType && !local && !conn.client {
+		return true, nil
+	}
+	if types == HeadersFrameType && !conn.client {
+		msg := fmt.Sprintf("stream(%d) initiated by client should be odd", streamID)
+		return false, &H2Error{PROTOCOL_ERROR, msg}
+	}
+	msg := fmt.Sprintf("%v FRAME for idle stream(%d)", types, streamID)
+	return false, &H2Error{PROTOCOL_ERROR, msg}
+}
+
+// checkPushPromise validates PUSH_PROMISE and its promised stream id.
+// promised stream is even, unused, and only server can push
+// when we enabled it (RFC 7540 5.1.1, 8.2).
+func (conn *Conn) checkPushPromise(frame *PushPromiseFrame) *H2Error {
+	if !conn.client {
+		return &H2Error{PROTOCOL_ERROR, "PUSH_PROMISE from client"}
+	}
+
+	conn.settingsMu.Lock()
+	enablePush := conn.Settings.EnablePush()
+	conn.settingsMu.Unlock()
+	if !enablePush {
+		return &H2Error{PROTOCOL_ERROR, "PUSH_PROMISE while push is disabled"}
+	}
+
+	promisedID := frame.PromisedStreamID
+	if promisedID == 0 || promisedID%2 != 0 {
+		msg := fmt.Sprintf("promised stream(%d) should be even", promisedID)
+		return &H2Error{PROTOCOL_ERROR, msg}
+	}
+
+	conn.mu.Lock()
+	lastStreamID := conn.LastStreamID
+	_, used := conn.Streams[promisedID]
+	conn.mu.Unlock()
+	if used || promisedID <= lastStreamID {
+		msg := fmt.Sprintf("promised stream(%d) is already used", promisedID)
+		return &H2Error{PROTOCOL_ERROR, msg}
+	}
+	return nil
+}
+
+// ResetStream handles stream error (RFC 7540 5.4.2).
+// it sends RST_STREAM and closes only the stream,
+// other streams on connection continue.
+func (conn *Conn) ResetStream(stream *Stream, streamError *StreamError) {
+	Error("%v", streamError)
+
+	// no frame is written on the stream after RST_STREAM
+	stream.writeMu.Lock()
+	conn.Write(NewRstStreamFrame(stream.ID, streamError.ErrorCode))
+	stream.Reset(streamError)
+	stream.writeMu.Unlock()
+
+	conn.closeStream(stream, closedByResetSent)
+}
+
+// closeReason is why stream was closed,
+// which decides how to handle frames arriving after it.
+type closeReason int
+
+const (
+	// END_STREAM was sent and received
+	closedByEndStream closeReason = iota
+	// we sent RST_STREAM, frames in flight are ignored
+	closedByResetSent
+	// peer sent RST_STREAM
+	closedByResetReceived
+	// peer sent GOAWAY with smaller last stream id
+	closedByGoAway
+)
+
+// number of closed streams remembered by connection,
+// streams closed before them are handled by stream id.
+const maxClosedStreams = 128
+
+// closedStreams is bounded record of recently closed streams,
+// the oldest one is forgotten when it is full.
+type closedStreams struct {
+	ids     []uint32 // ring buffer in order of close
+	next    int      // index of the oldest when full
+	reasons map[uint32]closeReason
 }
 
-func (conn *Conn) GoAway(streamId uint32, h2Error *H2Error) {
+func newClosedStreams(size int) *closedStreams {
+	return &closedStreams{
+		ids:     make([]uint32, 0, size),
+		reasons: make(map[uint32]closeReason, size),
+	}
+}
+
+func (closed *closedStreams) add(streamID uint32, reason closeReason) {
+	if _, ok := closed.reasons[streamID]; ok {
+		return
+	}
+	if len(closed.ids) < cap(closed.ids) {
+		closed.ids = append(closed.ids, streamID)
+	} else {
+		delete(closed.reasons, closed.ids[closed.next])
+		closed.ids[closed.next] = streamID
+		closed.next = (closed.next + 1) % len(closed.ids)
+	}
+	closed.reasons[streamID] = reason
+}
+
+func (closed *closedStreams) get(streamID uint32) (reason closeReason, ok bool) {
+	reason, ok = closed.reasons[streamID]
+	return
+}
+
+// closeStream removes closed stream from Streams,
+// remembers it with reason and finishes ReadLoop of stream.
+func (conn *Conn) closeStream(stream *Stream, reason closeReason) {
+	conn.mu.Lock()
+	delete(conn.Streams, stream.ID)
+	conn.closedStreams.add(stream.ID, reason)
+	Debug("close stream (id=%d) total (%d)", stream.ID, len(conn.Streams))
+	conn.mu.Unlock()
+	stream.finish()
+}
+
+// closedReason returns reason of recently closed stream
+func (conn *Conn) closedReason(streamID uint32) (closeReason, bool) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.closedStreams.get(streamID)
+}
+
+// goAwayAndWait sends GOAWAY and waits it was written,
+// so that connection can be closed after it.
+func (conn *Conn) goAwayAndWait(h2Error *H2Error) error {
 	Debug("connection close with GO_AWAY(%v)", h2Error)
-	errorCode := h2Error.ErrorCode
-	additionalDebugData := []byte(h2Error.AdditiolanDebugData)
-	goaway := NewGoAwayFrame(streamId, conn.LastStreamID, errorCode, additionalDebugData)
-	conn.WriteChan <- goaway
+	conn.mu.Lock()
+	conn.GoAwaySent = true
+	lastStreamID := conn.LastStreamID
+	conn.mu.Unlock()
+	goaway := NewGoAwayFrame(0, lastStreamID, h2Error.ErrorCode, []byte(h2Error.AdditiolanDebugData))
+	return conn.WriteAndWait(goaway)
+}
+
+// net.Conn and tls.Conn have deadlines
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// setReadDeadline sets deadline to read next frame,
+// and returns error for GOAWAY when it expires.
+// header block should be completed in ReadHeaderTimeout,
+// and next frame should come in ReadTimeout while peer is sending streams.
+// idle connection is closed by closeIdle, not by deadline.
+func (conn *Conn) setReadDeadline() *H2Error {
+	rw, ok := conn.RW.(deadliner)
+	if !ok || (conn.ReadTimeout == 0 && conn.ReadHeaderTimeout == 0) {
+		return nil
+	}
+
+	var deadline time.Time
+	var h2Error *H2Error
+	if conn.ReadTimeout > 0 && conn.receivingStreams() > 0 {
+		deadline = time.Now().Add(conn.ReadTimeout)
+		h2Error = &H2Error{ENHANCE_YOUR_CALM, "read timeout"}
+	}
+	if conn.ReadHeaderTimeout > 0 && conn.HeaderBlock != nil {
+		headerDeadline := conn.headerBlockStart.Add(conn.ReadHeaderTimeout)
+		if deadline.IsZero() || headerDeadline.Before(deadline) {
+			deadline = headerDeadline
+			h2Error = &H2Error{ENHANCE_YOUR_CALM, "header read timeout"}
+		}
+	}
+	rw.SetReadDeadline(deadline) // zero means no deadline
+	return h2Error
+}
+
+// receivingStreams returns number of streams
+// on which peer has not sent END_STREAM yet.
+func (conn *Conn) receivingStreams() (n int) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	for _, stream := range conn.Streams {
+		if stream.IsClosed() {
+			continue
+		}
+		switch stream.GetState() {
+		case OPEN, HALF_CLOSED_LOCAL, RESERVED_REMOTE:
+			n++
+		}
+	}
+	return n
+}
+
+// closeIdle closes connection with GOAWAY
+// when no stream is active for IdleTimeout.
+func (conn *Conn) closeIdle() {
+	ticker := time.NewTicker(conn.IdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-conn.closed:
+			return
+		}
+
+		active := conn.ActiveStreams(true) + conn.ActiveStreams(false)
+		conn.mu.Lock()
+		if active > 0 {
+			conn.lastActive = time.Now()
+		}
+		idle := time.Since(conn.lastActive)
+		conn.mu.Unlock()
+		if idle < conn.IdleTimeout {
+			continue
+		}
+
+		Info("close idle connection after %v", idle)
+		conn.goAwayAndWait(&H2Error{NO_ERROR, "idle timeout"})
+		conn.closeRW()
+		return
+	}
+}
+
+// ReserveWindow reserves size up to length for DATA Frame on stream
+// from both stream and connection window.
+// it blocks until WINDOW_UPDATE gives room, ctx is done,
+// or stream or connection is closed.
+func (conn *Conn) ReserveWindow(ctx context.Context, stream *Stream, length int32) (int32, error) {
+	size, err := stream.Window.Acquire(ctx, length)
+	if err != nil {
+		return 0, fmt.Errorf("stream(%d): %v", stream.ID, err)
+	}
+
+	reserved, err := conn.Window.Acquire(ctx, size)
+	if err != nil {
+		stream.Window.Release(size)
+		return 0, fmt.Errorf("connection: %v", err)
+	}
+
+	// connection window is smaller than stream window
+	if reserved < size {
+		stream.Window.Release(size - reserved)
+	}
+	return reserved, nil
 }
 
 func (conn *Conn) WindowConsume(length int32) {
@@ -285,7 +1655,7 @@ func (conn *Conn) WindowConsume(length int32) {
 
 	// update があれば WindowUpdate を送る
 	if update > 0 {
-		conn.WriteChan <- NewWindowUpdateFrame(0, uint32(update))
+		conn.Write(NewWindowUpdateFrame(0, uint32(update)))
 		conn.Window.Update(update)
 	}
 }
@@ -300,6 +1670,12 @@ func (conn *Conn) WriteMagic() (err error) {
 }
 
 func (conn *Conn) ReadMagic() (err error) {
+	// slow client can not hold connection before preface
+	if rw, ok := conn.RW.(deadliner); ok && conn.ReadHeaderTimeout > 0 {
+		rw.SetReadDeadline(time.Now().Add(conn.ReadHeaderTimeout))
+		defer rw.SetReadDeadline(time.Time{})
+	}
+
 	magic := make([]byte, len(CONNECTION_PREFACE))
 	_, err = conn.RW.Read(magic)
 	if err != nil {
@@ -313,14 +1689,31 @@ func (conn *Conn) ReadMagic() (err error) {
 	return
 }
 
+// Close closes all streams and stops WriteLoop.
+// it can be called more than once from any goroutine.
+// WriteChan is not closed, because streams may send to it,
+// frames for closed connection are dropped in Write.
+// closed is closed in lock of mu, so that no stream is added after it.
 func (conn *Conn) Close() {
-	Info("close all conn.Streams")
-	for i, stream := range conn.Streams {
-		if stream != nil {
+	conn.closeOnce.Do(func() {
+		Info("close all conn.Streams")
+		conn.mu.Lock()
+		close(conn.closed)
+		for i, stream := range conn.Streams {
 			Debug("close stream(%d)", i)
 			stream.Close()
 		}
+		conn.mu.Unlock()
+		conn.Window.Close()
+	})
+}
+
+// IsClosed reports whether Close was called
+func (conn *Conn) IsClosed() bool {
+	select {
+	case <-conn.closed:
+		return true
+	default:
+		return false
 	}
-	Info("close conn.WriteChan")
-	close(conn.WriteChan)
 }
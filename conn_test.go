@@ -0,0 +1,490 @@
+package http2
+
+import (
+	"github.com/Jxck/hpack"
+	. "github.com/Jxck/http2/frame"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stream identifiers which violate RFC 7540 5.1.1
+// close connection with GOAWAY PROTOCOL_ERROR.
+func TestInvalidStreamID(t *testing.T) {
+	var cases = []struct {
+		name   string
+		frames func(conn net.Conn)
+	}{
+		{"even stream from client", func(conn net.Conn) {
+			NewHeadersFrame(END_STREAM+END_HEADERS, 2, nil, testHeaderBlock("/"), nil).Write(conn)
+		}},
+		{"decreasing stream id", func(conn net.Conn) {
+			NewHeadersFrame(END_STREAM+END_HEADERS, 5, nil, testHeaderBlock("/"), nil).Write(conn)
+			NewHeadersFrame(END_STREAM+END_HEADERS, 3, nil, testHeaderBlock("/"), nil).Write(conn)
+		}},
+		{"DATA for idle stream", func(conn net.Conn) {
+			NewDataFrame(END_STREAM, 1, []byte("idle"), nil).Write(conn)
+		}},
+		{"WINDOW_UPDATE for idle stream", func(conn net.Conn) {
+			NewWindowUpdateFrame(1, 1024).Write(conn)
+		}},
+		{"PUSH_PROMISE from client", func(conn net.Conn) {
+			NewHeadersFrame(END_HEADERS, 1, nil, testHeaderBlock("/"), nil).Write(conn)
+			NewPushPromiseFrame(END_HEADERS, 1, 2, testHeaderBlock("/push"), nil).Write(conn)
+		}},
+	}
+
+	for _, c := range cases {
+		conn, done := testRawConn(t, &Server{})
+		c.frames(conn)
+		goaway := readGoAway(t, conn, nil)
+		if goaway == nil || goaway.ErrorCode != PROTOCOL_ERROR {
+			t.Errorf("%s: got %v, want GOAWAY PROTOCOL_ERROR", c.name, goaway)
+		}
+		conn.Close()
+		<-done
+	}
+}
+
+// streams skipped by client are closed, frames for them
+// are ignored or reset without closing connection.
+func TestClosedStreamID(t *testing.T) {
+	conn, done := testRawConn(t, &Server{})
+	defer func() {
+		conn.Close()
+		<-done
+	}()
+
+	NewHeadersFrame(END_STREAM+END_HEADERS, 5, nil, testHeaderBlock("/"), nil).Write(conn)
+	NewWindowUpdateFrame(3, 1024).Write(conn)
+	NewRstStreamFrame(1, CANCEL).Write(conn)
+	NewPriorityFrame(7, false, 0, 16).Write(conn)
+	NewDataFrame(END_STREAM, 3, []byte("closed"), nil).Write(conn)
+
+	settings := map[SettingsID]int32{SETTINGS_MAX_FRAME_SIZE: DEFAULT_MAX_FRAME_SIZE}
+	for {
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		frame, err := ReadFrame(conn, settings)
+		if err != nil {
+			t.Fatalf("no RST_STREAM: %v", err)
+		}
+		switch f := frame.(type) {
+		case *GoAwayFrame:
+			t.Fatalf("closed with %v", f.ErrorCode)
+		case *RstStreamFrame:
+			if f.StreamID != 3 || f.ErrorCode != STREAM_CLOSED {
+				t.Fatalf("got RST_STREAM %v for stream(%d), want STREAM_CLOSED for stream(3)", f.ErrorCode, f.StreamID)
+			}
+			return
+		}
+	}
+}
+
+// stream ids are allocated per connection,
+// and run out at MAX_STREAM_ID.
+func TestNextStreamID(t *testing.T) {
+	client, server := NewConn(nil), NewConn(nil)
+	client.client = true
+	for _, want := range []uint32{1, 3, 5} {
+		if id, _ := client.NextStreamID(); id != want {
+			t.Errorf("client got stream(%d), want stream(%d)", id, want)
+		}
+	}
+	for _, want := range []uint32{2, 4, 6} {
+		if id, _ := server.NextStreamID(); id != want {
+			t.Errorf("server got stream(%d), want stream(%d)", id, want)
+		}
+	}
+
+	client.nextStreamID = MAX_STREAM_ID - 2
+	for _, want := range []uint32{MAX_STREAM_ID - 2, MAX_STREAM_ID} {
+		if id, err := client.NextStreamID(); id != want || err != nil {
+			t.Errorf("got stream(%d) %v, want stream(%d)", id, err, want)
+		}
+	}
+	if _, err := client.NextStreamID(); err != ErrStreamIDExhausted {
+		t.Errorf("got %v, want %v", err, ErrStreamIDExhausted)
+	}
+	if client.CanTakeNewStream() {
+		t.Errorf("exhausted connection can take new stream")
+	}
+}
+
+// closed streams are remembered up to its size
+func TestClosedStreams(t *testing.T) {
+	closed := newClosedStreams(2)
+	closed.add(1, closedByEndStream)
+	closed.add(3, closedByResetSent)
+	closed.add(5, closedByResetReceived)
+
+	if _, ok := closed.get(1); ok {
+		t.Errorf("the oldest stream(1) is not forgotten")
+	}
+	if reason, ok := closed.get(3); !ok || reason != closedByResetSent {
+		t.Errorf("got %v %v, want %v of stream(3)", reason, ok, closedByResetSent)
+	}
+	if reason, ok := closed.get(5); !ok || reason != closedByResetReceived {
+		t.Errorf("got %v %v, want %v of stream(5)", reason, ok, closedByResetReceived)
+	}
+}
+
+// late frames for closed stream are ignored or reset by reason of close,
+// without closing connection.
+func TestLateFrames(t *testing.T) {
+	conn, done := testRawConn(t, &Server{})
+	defer func() {
+		conn.Close()
+		<-done
+	}()
+	settings := map[SettingsID]int32{SETTINGS_MAX_FRAME_SIZE: DEFAULT_MAX_FRAME_SIZE}
+
+	// stream(1) is closed with response
+	NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, testHeaderBlock("/"), nil).Write(conn)
+	for end := false; !end; {
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		frame, err := ReadFrame(conn, settings)
+		if err != nil {
+			t.Fatalf("no response: %v", err)
+		}
+		header := frame.Header()
+		end = header.StreamID == 1 && header.Flags&END_STREAM == END_STREAM
+	}
+
+	// stream(3) is reset by server
+	header := http.Header{
+		":method":        {"POST"},
+		":path":          {"/"},
+		":scheme":        {"https"},
+		":authority":     {"example.com"},
+		"content-length": {"1"},
+	}
+	block := hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE)).Encode(*hpack.ToHeaderList(header))
+	NewHeadersFrame(END_HEADERS, 3, nil, block, nil).Write(conn)
+	NewDataFrame(UNSET, 3, []byte("too long"), nil).Write(conn)
+
+	// ignored
+	NewWindowUpdateFrame(1, 1024).Write(conn)
+	NewRstStreamFrame(1, CANCEL).Write(conn)
+	NewDataFrame(END_STREAM, 3, []byte("in flight"), nil).Write(conn)
+	// STREAM_CLOSED
+	NewDataFrame(END_STREAM, 1, []byte("late"), nil).Write(conn)
+
+	want := map[uint32]ErrorCode{3: PROTOCOL_ERROR, 1: STREAM_CLOSED}
+	for len(want) > 0 {
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		frame, err := ReadFrame(conn, settings)
+		if err != nil {
+			t.Fatalf("RST_STREAM for %v not received: %v", want, err)
+		}
+		switch f := frame.(type) {
+		case *GoAwayFrame:
+			t.Fatalf("closed with %v", f.ErrorCode)
+		case *RstStreamFrame:
+			if code, ok := want[f.StreamID]; !ok || code != f.ErrorCode {
+				t.Fatalf("unexpected RST_STREAM %v for stream(%d)", f.ErrorCode, f.StreamID)
+			}
+			delete(want, f.StreamID)
+		}
+	}
+}
+
+// header block should be continued only by CONTINUATION on the same stream,
+// and is limited by MaxHeaderBlockSize.
+func TestHeaderBlock(t *testing.T) {
+	var cases = []struct {
+		name   string
+		frames func(conn net.Conn)
+		code   ErrorCode
+	}{
+		{"PING in header block", func(conn net.Conn) {
+			NewHeadersFrame(END_STREAM, 1, nil, testHeaderBlock("/"), nil).Write(conn)
+			NewPingFrame(UNSET, 0, []byte("interrup")).Write(conn)
+		}, PROTOCOL_ERROR},
+		{"CONTINUATION of other stream", func(conn net.Conn) {
+			NewHeadersFrame(END_STREAM, 1, nil, testHeaderBlock("/"), nil).Write(conn)
+			NewContinuationFrame(END_HEADERS, 3, nil).Write(conn)
+		}, PROTOCOL_ERROR},
+		{"CONTINUATION without HEADERS", func(conn net.Conn) {
+			NewContinuationFrame(END_HEADERS, 1, testHeaderBlock("/")).Write(conn)
+		}, PROTOCOL_ERROR},
+		{"over MaxHeaderBlockSize", func(conn net.Conn) {
+			NewHeadersFrame(END_STREAM, 1, nil, testHeaderBlock("/"), nil).Write(conn)
+			fragment := make([]byte, DEFAULT_MAX_FRAME_SIZE)
+			for size := 0; size <= DEFAULT_MAX_HEADER_BLOCK_SIZE; size += len(fragment) {
+				if NewContinuationFrame(UNSET, 1, fragment).Write(conn) != nil {
+					return
+				}
+			}
+		}, ENHANCE_YOUR_CALM},
+	}
+
+	for _, c := range cases {
+		conn, done := testRawConn(t, &Server{})
+		c.frames(conn)
+		goaway := readGoAway(t, conn, nil)
+		if goaway == nil || goaway.ErrorCode != c.code {
+			t.Errorf("%s: got %v, want GOAWAY %v", c.name, goaway, c.code)
+		}
+		conn.Close()
+		<-done
+	}
+}
+
+// dynamic table size update from peer is limited by
+// SETTINGS_HEADER_TABLE_SIZE we advertised and acknowledged,
+// and allowed only at the beginning of header block.
+func TestHeaderTableSize(t *testing.T) {
+	var cases = []struct {
+		name     string
+		settings Settings
+		size     uint32
+		after    bool // after header field
+		goaway   bool
+	}{
+		{"default", nil, uint32(DEFAULT_HEADER_TABLE_SIZE), false, false},
+		{"over default", nil, 65536, false, true},
+		{"advertised", Settings{SETTINGS_HEADER_TABLE_SIZE: 65536}, 65536, false, false},
+		{"over advertised", Settings{SETTINGS_HEADER_TABLE_SIZE: 65536}, 65537, false, true},
+		{"after header field", nil, 100, true, true},
+		{"over default after header field", nil, 65536, true, true},
+	}
+
+	for _, c := range cases {
+		conn, done := testRawConn(t, &Server{Settings: c.settings})
+		block := append(tableSizeUpdate(nil, c.size), testHeaderBlock("/")...)
+		if c.after {
+			block = append(testHeaderBlock("/"), tableSizeUpdate(nil, c.size)...)
+		}
+		NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, block, nil).Write(conn)
+
+		probe := []byte("probe!!!")
+		NewPingFrame(UNSET, 0, probe).Write(conn)
+		goaway := readGoAway(t, conn, probe)
+		if c.goaway && (goaway == nil || goaway.ErrorCode != COMPRESSION_ERROR) {
+			t.Errorf("%s: got %v, want GOAWAY COMPRESSION_ERROR", c.name, goaway)
+		}
+		if !c.goaway && goaway != nil {
+			t.Errorf("%s: closed with %v", c.name, goaway.ErrorCode)
+		}
+		conn.Close()
+		<-done
+	}
+}
+
+// trailers without END_STREAM reset only the stream,
+// and nothing is sent on it after RST_STREAM.
+func TestTrailerWithoutEndStream(t *testing.T) {
+	conn, done := testRawConn(t, &Server{})
+	defer func() {
+		conn.Close()
+		<-done
+	}()
+	settings := map[SettingsID]int32{SETTINGS_MAX_FRAME_SIZE: DEFAULT_MAX_FRAME_SIZE}
+
+	NewHeadersFrame(END_HEADERS, 1, nil, testHeaderBlock("/"), nil).Write(conn)
+	trailer := hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE)).Encode(*hpack.ToHeaderList(http.Header{"x-trailer": {"value"}}))
+	NewHeadersFrame(END_HEADERS, 1, nil, trailer, nil).Write(conn)
+
+	reset := false
+	for {
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		frame, err := ReadFrame(conn, settings)
+		if err != nil {
+			t.Fatalf("RST_STREAM not received: %v", err)
+		}
+		switch f := frame.(type) {
+		case *GoAwayFrame:
+			t.Fatalf("closed with %v", f.ErrorCode)
+		case *RstStreamFrame:
+			if f.ErrorCode != PROTOCOL_ERROR {
+				t.Fatalf("got RST_STREAM %v, want PROTOCOL_ERROR", f.ErrorCode)
+			}
+			reset = true
+			NewPingFrame(UNSET, 0, []byte("probe!!!")).Write(conn)
+		case *PingFrame:
+			if reset && f.Flags == ACK {
+				return
+			}
+		default:
+			if reset && f.Header().StreamID == 1 {
+				t.Fatalf("%v frame after RST_STREAM", f.Header().Type)
+			}
+		}
+	}
+}
+
+// DATA over stream window we advertised resets the stream,
+// and DATA over connection window closes connection.
+func TestReceiveWindow(t *testing.T) {
+	// handler never reads body, so window is not updated
+	block := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	})
+	defer close(block)
+	header := func(streamID uint32) Frame {
+		return NewHeadersFrame(END_HEADERS, streamID, nil, testHeaderBlock("/"), nil)
+	}
+
+	// stream window
+	conn, done := testRawConnHandler(t, &Server{Settings: Settings{SETTINGS_INITIAL_WINDOW_SIZE: 1000}}, handler)
+	header(1).Write(conn)
+	NewDataFrame(UNSET, 1, make([]byte, 1000), nil).Write(conn)
+	header(3).Write(conn)
+	NewDataFrame(UNSET, 3, make([]byte, 1001), nil).Write(conn)
+
+	settings := map[SettingsID]int32{SETTINGS_MAX_FRAME_SIZE: DEFAULT_MAX_FRAME_SIZE}
+	for reset := false; !reset; {
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		frame, err := ReadFrame(conn, settings)
+		if err != nil {
+			t.Fatalf("RST_STREAM not received: %v", err)
+		}
+		switch f := frame.(type) {
+		case *GoAwayFrame:
+			t.Fatalf("closed with %v", f.ErrorCode)
+		case *RstStreamFrame:
+			if f.StreamID != 3 || f.ErrorCode != FLOW_CONTROL_ERROR {
+				t.Fatalf("got RST_STREAM %v for stream(%d), want FLOW_CONTROL_ERROR for stream(3)", f.ErrorCode, f.StreamID)
+			}
+			reset = true
+		}
+	}
+	conn.Close()
+	<-done
+
+	// connection window, stream window is larger than it
+	conn, done = testRawConnHandler(t, &Server{Settings: Settings{SETTINGS_INITIAL_WINDOW_SIZE: 1 << 20}}, handler)
+	header(1).Write(conn)
+	for size := 0; size <= DEFAULT_INITIAL_WINDOW_SIZE; size += DEFAULT_MAX_FRAME_SIZE {
+		NewDataFrame(UNSET, 1, make([]byte, DEFAULT_MAX_FRAME_SIZE), nil).Write(conn)
+	}
+	goaway := readGoAway(t, conn, nil)
+	if goaway == nil || goaway.ErrorCode != FLOW_CONTROL_ERROR {
+		t.Errorf("got %v, want GOAWAY FLOW_CONTROL_ERROR", goaway)
+	}
+	conn.Close()
+	<-done
+}
+
+// closed connection takes no new stream,
+// because Close never closes streams added after it.
+func TestClosedConn(t *testing.T) {
+	conn := NewConn(nil)
+	conn.client = true
+	if !conn.CanTakeNewStream() {
+		t.Fatalf("new connection can not take new stream")
+	}
+
+	conn.Close()
+	if conn.CanTakeNewStream() {
+		t.Errorf("closed connection can take new stream")
+	}
+	stream := NewStream(conn, 1, nil)
+	defer stream.Close()
+	if err := conn.AddStream(stream); err != ErrConnClosed {
+		t.Errorf("got %v, want %v", err, ErrConnClosed)
+	}
+}
+
+// streams over last stream id of GOAWAY are failed
+// and removed from connection.
+func TestGoAwayUnprocessed(t *testing.T) {
+	conn := NewConn(nil)
+	conn.client = true
+	defer conn.Close()
+	for _, id := range []uint32{1, 3, 5} {
+		if err := conn.AddStream(NewStream(conn, id, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn.HandleGoAway(NewGoAwayFrame(0, 1, NO_ERROR, nil))
+
+	if n := conn.ActiveStreams(true); n != 1 {
+		t.Errorf("got %d active streams, want 1", n)
+	}
+	for _, id := range []uint32{3, 5} {
+		if reason, ok := conn.closedReason(id); !ok || reason != closedByGoAway {
+			t.Errorf("got %v %v, want %v of stream(%d)", reason, ok, closedByGoAway, id)
+		}
+	}
+}
+
+// header block larger than peer's MAX_FRAME_SIZE is sent in HEADERS
+// and CONTINUATION Frames, with END_HEADERS only on the last one,
+// and no other frame is written between them.
+func TestHeaderBlockFragment(t *testing.T) {
+	const size = 40000
+	value := strings.Repeat("a", size)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-large", value)
+		w.Write([]byte("ok"))
+	})
+	conn, done := testRawConnHandler(t, &Server{}, handler)
+	defer func() {
+		conn.Close()
+		<-done
+	}()
+
+	// MAX_FRAME_SIZE is the smallest, and streams are responded concurrently
+	NewSettingsFrame(UNSET, 0, map[SettingsID]int32{SETTINGS_MAX_FRAME_SIZE: DEFAULT_MAX_FRAME_SIZE}).Write(conn)
+	streams := []uint32{1, 3, 5}
+	for _, streamID := range streams {
+		NewHeadersFrame(END_STREAM+END_HEADERS, streamID, nil, testHeaderBlock("/"), nil).Write(conn)
+		NewPingFrame(UNSET, 0, []byte("interrup")).Write(conn)
+	}
+
+	settings := map[SettingsID]int32{SETTINGS_MAX_FRAME_SIZE: DEFAULT_MAX_FRAME_SIZE}
+	decoder := hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))
+	var block []byte
+	var blockStream uint32
+	var fragments int
+	received := 0
+	for received < len(streams) {
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		frame, err := ReadFrame(conn, settings)
+		if err != nil {
+			t.Fatalf("%d header blocks received: %v", received, err)
+		}
+		header := frame.Header()
+
+		if blockStream != 0 {
+			// header block continues only by CONTINUATION of the same stream
+			f, ok := frame.(*ContinuationFrame)
+			if !ok || header.StreamID != blockStream {
+				t.Fatalf("%v frame on stream(%d) in header block of stream(%d)", header.Type, header.StreamID, blockStream)
+			}
+			block = append(block, f.HeaderBlockFragment...)
+			fragments++
+		} else {
+			switch f := frame.(type) {
+			case *ContinuationFrame:
+				t.Fatalf("CONTINUATION on stream(%d) without HEADERS", header.StreamID)
+			case *HeadersFrame:
+				blockStream, block, fragments = header.StreamID, f.HeaderBlockFragment, 1
+			default:
+				continue
+			}
+		}
+		if header.Length > DEFAULT_MAX_FRAME_SIZE {
+			t.Fatalf("%v frame of %d byte over MAX_FRAME_SIZE", header.Type, header.Length)
+		}
+		if header.Flags&END_HEADERS != END_HEADERS {
+			continue
+		}
+
+		// whole header block is decoded
+		decoder.Decode(block)
+		if got := decoder.ES.ToHeader().Get("x-large"); got != value {
+			t.Errorf("stream(%d): got header of %d byte, want %d byte", blockStream, len(got), size)
+		}
+		if fragments < 3 {
+			t.Errorf("stream(%d): header block of %d byte in %d frames", blockStream, len(block), fragments)
+		}
+		blockStream = 0
+		received++
+	}
+}
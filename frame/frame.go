@@ -99,6 +99,20 @@ func (e H2Error) String() string {
 	return fmt.Sprintf("%v(%v)", e.ErrorCode, e.AdditiolanDebugData)
 }
 
+// StreamError is error of only one stream (RFC 7540 5.4.2),
+// which is reset by RST_STREAM and other streams continue.
+// H2Error is connection error (RFC 7540 5.4.1),
+// which closes connection with GOAWAY.
+type StreamError struct {
+	StreamID  uint32
+	ErrorCode ErrorCode
+	Reason    string
+}
+
+func (e StreamError) Error() string {
+	return fmt.Sprintf("stream(%d) %v(%v)", e.StreamID, e.ErrorCode, e.Reason)
+}
+
 // Flags
 type Flag uint8
 
@@ -902,6 +916,7 @@ type PushPromiseFrame struct {
 	PadLength           uint8
 	PromisedStreamID    uint32
 	HeaderBlockFragment []byte
+	Headers             http.Header
 	Padding             []byte
 }
 
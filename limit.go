@@ -0,0 +1,145 @@
+package http2
+
+import (
+	"fmt"
+	. "github.com/Jxck/http2/frame"
+	. "github.com/Jxck/logger"
+	"log"
+	"time"
+)
+
+func init() {
+	log.SetFlags(log.Lshortfile)
+}
+
+// Limits are budgets of frames which cost us without progress
+// of streams, against resource exhaustion attacks like
+// Rapid Reset (CVE-2023-44487), CONTINUATION flood, ping flood and settings flood.
+// peer exceeding one of them is closed with GOAWAY ENHANCE_YOUR_CALM.
+// 0 means default, and negative means no limit.
+type Limits struct {
+	// frames received in Interval
+	MaxResetStreams int // RST_STREAM
+	MaxPings        int // PING without ACK
+	MaxSettings     int // SETTINGS without ACK
+	MaxEmptyData    int // DATA without payload nor END_STREAM
+	MaxPriority     int // PRIORITY
+
+	// CONTINUATION Frames in one header block
+	MaxContinuations int
+
+	// period to count frames, 1s if 0
+	Interval time.Duration
+}
+
+var DefaultLimits = Limits{
+	MaxResetStreams:  100,
+	MaxPings:         100,
+	MaxSettings:      20,
+	MaxEmptyData:     100,
+	MaxPriority:      1000,
+	MaxContinuations: 100,
+	Interval:         time.Second,
+}
+
+// limit returns value of limits or default
+func limit(value, defaultValue int) int {
+	if value == 0 {
+		return defaultValue
+	}
+	return value
+}
+
+// budget counts frames of one type in interval
+// it is used only in conn.ReadLoop.
+type budget struct {
+	name  string
+	limit int
+	count int
+	start time.Time
+}
+
+// spend counts a frame, and returns error
+// when frames in interval exceeded limit.
+func (b *budget) spend(interval time.Duration) *H2Error {
+	if b.limit < 0 {
+		return nil
+	}
+
+	now := time.Now()
+	if now.Sub(b.start) >= interval {
+		b.start = now
+		b.count = 0
+	}
+	b.count++
+
+	if b.count > b.limit {
+		msg := fmt.Sprintf("too many %s (over %d in %v)", b.name, b.limit, interval)
+		Error("%v", msg)
+		return &H2Error{ENHANCE_YOUR_CALM, msg}
+	}
+	return nil
+}
+
+// budgets of a connection made from Limits
+type budgets struct {
+	interval         time.Duration
+	maxContinuations int
+	continuations    int // in current header block
+	resetStreams     budget
+	pings            budget
+	settings         budget
+	emptyData        budget
+	priority         budget
+}
+
+func newBudgets(limits Limits) *budgets {
+	interval := limits.Interval
+	if interval <= 0 {
+		interval = DefaultLimits.Interval
+	}
+	return &budgets{
+		interval:         interval,
+		maxContinuations: limit(limits.MaxContinuations, DefaultLimits.MaxContinuations),
+		resetStreams:     budget{name: "RST_STREAM", limit: limit(limits.MaxResetStreams, DefaultLimits.MaxResetStreams)},
+		pings:            budget{name: "PING", limit: limit(limits.MaxPings, DefaultLimits.MaxPings)},
+		settings:         budget{name: "SETTINGS", limit: limit(limits.MaxSettings, DefaultLimits.MaxSettings)},
+		emptyData:        budget{name: "empty DATA", limit: limit(limits.MaxEmptyData, DefaultLimits.MaxEmptyData)},
+		priority:         budget{name: "PRIORITY", limit: limit(limits.MaxPriority, DefaultLimits.MaxPriority)},
+	}
+}
+
+// spend counts frame received against budgets,
+// and returns error if peer exceeded one of them.
+func (b *budgets) spend(frame Frame) *H2Error {
+	header := frame.Header()
+	switch f := frame.(type) {
+	case *RstStreamFrame:
+		return b.resetStreams.spend(b.interval)
+	case *PingFrame:
+		if header.Flags&ACK != ACK {
+			return b.pings.spend(b.interval)
+		}
+	case *SettingsFrame:
+		if header.Flags&ACK != ACK {
+			return b.settings.spend(b.interval)
+		}
+	case *DataFrame:
+		if len(f.Data) == 0 && header.Flags&END_STREAM != END_STREAM {
+			return b.emptyData.spend(b.interval)
+		}
+	case *PriorityFrame:
+		return b.priority.spend(b.interval)
+	case *HeadersFrame, *PushPromiseFrame:
+		// new header block
+		b.continuations = 0
+	case *ContinuationFrame:
+		b.continuations++
+		if b.maxContinuations >= 0 && b.continuations > b.maxContinuations {
+			msg := fmt.Sprintf("too many CONTINUATION (over %d in a header block)", b.maxContinuations)
+			Error("%v", msg)
+			return &H2Error{ENHANCE_YOUR_CALM, msg}
+		}
+	}
+	return nil
+}
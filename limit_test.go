@@ -0,0 +1,180 @@
+package http2
+
+import (
+	"bytes"
+	"github.com/Jxck/hpack"
+	. "github.com/Jxck/http2/frame"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// testRawConn serves srv on one end of tcp connection,
+// and returns the other end after handshake, so that
+// test can send frames as malicious client.
+func testRawConn(t *testing.T, srv *Server) (conn net.Conn, done chan struct{}) {
+	return testRawConnHandler(t, srv, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+}
+
+// testRawConnHandler is testRawConn served by handler
+func testRawConnHandler(t *testing.T, srv *Server, handler http.Handler) (conn net.Conn, done chan struct{}) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	conn, err = net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done = make(chan struct{})
+	go func() {
+		srv.ServeConn(server, handler)
+		server.Close()
+		close(done)
+	}()
+
+	conn.Write([]byte(CONNECTION_PREFACE))
+	NewSettingsFrame(UNSET, 0, NilSettings).Write(conn)
+	NewSettingsFrame(ACK, 0, NilSettings).Write(conn)
+	return conn, done
+}
+
+func testHeaderBlock(path string) []byte {
+	header := http.Header{
+		":method":    {"GET"},
+		":path":      {path},
+		":scheme":    {"https"},
+		":authority": {"example.com"},
+	}
+	return hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE)).Encode(*hpack.ToHeaderList(header))
+}
+
+// readGoAway reads frames until GOAWAY or PING ACK of probe
+func readGoAway(t *testing.T, conn net.Conn, probe []byte) *GoAwayFrame {
+	settings := map[SettingsID]int32{SETTINGS_MAX_FRAME_SIZE: DEFAULT_MAX_FRAME_SIZE}
+	for {
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		frame, err := ReadFrame(conn, settings)
+		if err != nil {
+			t.Fatalf("neither GOAWAY nor PING ACK: %v", err)
+		}
+		switch f := frame.(type) {
+		case *GoAwayFrame:
+			return f
+		case *PingFrame:
+			if f.Flags == ACK && bytes.Equal(f.OpaqueData, probe) {
+				return nil
+			}
+		}
+	}
+}
+
+// each abuse pattern is accepted up to its budget,
+// and connection is closed with ENHANCE_YOUR_CALM over it.
+func TestLimits(t *testing.T) {
+	const max = 10
+	limits := Limits{
+		MaxResetStreams: max,
+		MaxPings:        max,
+		MaxSettings:     max,
+		MaxEmptyData:    max,
+		MaxPriority:     max,
+		Interval:        time.Minute,
+	}
+
+	var cases = []struct {
+		name  string
+		flood func(conn net.Conn, i int)
+	}{
+		{"rapid reset", func(conn net.Conn, i int) {
+			streamID := uint32(i*2 + 1)
+			NewHeadersFrame(END_STREAM+END_HEADERS, streamID, nil, testHeaderBlock("/"), nil).Write(conn)
+			NewRstStreamFrame(streamID, CANCEL).Write(conn)
+		}},
+		{"ping flood", func(conn net.Conn, i int) {
+			NewPingFrame(UNSET, 0, []byte("flooding")).Write(conn)
+		}},
+		{"settings flood", func(conn net.Conn, i int) {
+			NewSettingsFrame(UNSET, 0, NilSettings).Write(conn)
+		}},
+		{"empty data", func(conn net.Conn, i int) {
+			if i == 0 {
+				NewHeadersFrame(END_HEADERS, 1, nil, testHeaderBlock("/"), nil).Write(conn)
+			}
+			NewDataFrame(UNSET, 1, nil, nil).Write(conn)
+		}},
+		{"priority flood", func(conn net.Conn, i int) {
+			NewPriorityFrame(uint32(i*2+1), false, 0, 16).Write(conn)
+		}},
+	}
+
+	for _, c := range cases {
+		conn, done := testRawConn(t, &Server{Limits: limits})
+
+		// up to budget (probe PING is counted in ping flood)
+		for i := 0; i < max-1; i++ {
+			c.flood(conn, i)
+		}
+		probe := []byte("probe!!!")
+		NewPingFrame(UNSET, 0, probe).Write(conn)
+		if goaway := readGoAway(t, conn, probe); goaway != nil {
+			t.Errorf("%s: closed in budget with %v", c.name, goaway.ErrorCode)
+		}
+
+		// over budget
+		for i := max - 1; i < max+1; i++ {
+			c.flood(conn, i)
+		}
+		goaway := readGoAway(t, conn, nil)
+		if goaway == nil || goaway.ErrorCode != ENHANCE_YOUR_CALM {
+			t.Errorf("%s: got %v, want GOAWAY ENHANCE_YOUR_CALM", c.name, goaway)
+		}
+
+		conn.Close()
+		<-done
+	}
+}
+
+// zero-length CONTINUATION Frames never grow header block,
+// but number of them in one block is limited.
+func TestContinuationFlood(t *testing.T) {
+	const max = 10
+	conn, done := testRawConn(t, &Server{Limits: Limits{MaxContinuations: max}})
+	defer func() {
+		conn.Close()
+		<-done
+	}()
+
+	// in budget
+	NewHeadersFrame(END_STREAM, 1, nil, testHeaderBlock("/"), nil).Write(conn)
+	for i := 0; i < max-1; i++ {
+		NewContinuationFrame(UNSET, 1, nil).Write(conn)
+	}
+	NewContinuationFrame(END_HEADERS, 1, nil).Write(conn)
+
+	probe := []byte("probe!!!")
+	NewPingFrame(UNSET, 0, probe).Write(conn)
+	if goaway := readGoAway(t, conn, probe); goaway != nil {
+		t.Fatalf("closed in budget with %v", goaway.ErrorCode)
+	}
+
+	// over budget, header block never ends
+	NewHeadersFrame(END_STREAM, 3, nil, testHeaderBlock("/"), nil).Write(conn)
+	for i := 0; i < max+1; i++ {
+		NewContinuationFrame(UNSET, 3, nil).Write(conn)
+	}
+	goaway := readGoAway(t, conn, nil)
+	if goaway == nil || goaway.ErrorCode != ENHANCE_YOUR_CALM {
+		t.Errorf("got %v, want GOAWAY ENHANCE_YOUR_CALM", goaway)
+	}
+}
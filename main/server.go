@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
 	"fmt"
@@ -8,6 +9,9 @@ import (
 	"github.com/Jxck/logger"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 var (
@@ -58,9 +62,31 @@ $ go run main/server.go 3000
 		Handler:        handler,
 		MaxHeaderBytes: http.DefaultMaxHeaderBytes,
 		TLSConfig:      config,
-		TLSNextProto:   http2.TLSNextProto,
 	}
+	http2.ConfigureServer(server, &http2.Server{})
+
+	// shutdown gracefully by signal
+	// HTTP/2 connections are drained with GOAWAY
+	done := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			fmt.Println(err)
+			server.Close()
+		}
+		close(done)
+	}()
 
 	fmt.Println("server starts at localhost", port)
-	fmt.Println(server.ListenAndServeTLS(cert, key))
+	err := server.ListenAndServeTLS(cert, key)
+	if err != http.ErrServerClosed {
+		fmt.Println(err)
+		return
+	}
+	<-done
 }
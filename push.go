@@ -0,0 +1,407 @@
+package http2
+
+import (
+	"bytes"
+	"fmt"
+	. "github.com/Jxck/color"
+	. "github.com/Jxck/http2/frame"
+	. "github.com/Jxck/logger"
+	"io"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"sync"
+	"time"
+)
+
+// Push implements http.Pusher.
+// it sends PUSH_PROMISE on the stream of this response
+// and runs handler for promised request on reserved stream.
+func (r *ResponseWriter) Push(target string, opts *http.PushOptions) error {
+	stream := r.stream
+	conn := stream.Conn
+
+	// client disables push with SETTINGS_ENABLE_PUSH=0
+	if !conn.PushEnabled() {
+		return http.ErrNotSupported
+	}
+
+	// PUSH_PROMISE is sent only on client initiated stream
+	if stream.ID%2 == 0 {
+		return fmt.Errorf("push on pushed stream(%d)", stream.ID)
+	}
+
+	state := stream.GetState()
+	if state != OPEN && state != HALF_CLOSED_REMOTE {
+		return fmt.Errorf("push on stream(%d) at %v state", stream.ID, state)
+	}
+
+	if opts == nil {
+		opts = new(http.PushOptions)
+	}
+
+	method := opts.Method
+	if method == "" {
+		method = "GET"
+	}
+
+	// promised request should be cacheable and safe
+	if method != "GET" && method != "HEAD" {
+		return fmt.Errorf("method %q can not be pushed", method)
+	}
+
+	url, err := neturl.Parse(target)
+	if err != nil {
+		return err
+	}
+
+	scheme, authority := url.Scheme, url.Host
+	if scheme == "" {
+		scheme = "https"
+		if r.req != nil && r.req.URL.Scheme != "" {
+			scheme = r.req.URL.Scheme
+		}
+	}
+	if authority == "" && r.req != nil {
+		authority = r.req.Host
+	}
+
+	header := make(http.Header)
+	for name, values := range opts.Header {
+		header[name] = append([]string(nil), values...)
+	}
+	header.Add(":method", method)
+	header.Add(":scheme", scheme)
+	header.Add(":authority", authority)
+	header.Add(":path", url.RequestURI())
+
+	promised, err := conn.PushPromise(stream, header)
+	if err != nil {
+		return err
+	}
+
+	// promised request has no body
+	for name, values := range header {
+		promised.Bucket.Headers[name] = values
+	}
+	promised.Bucket.Body.CloseWithError(io.EOF)
+	promised.headerReceived = true
+
+	// response for promised request is sent on
+	// reserved stream by handler
+	go promised.CallBack(promised)
+
+	return nil
+}
+
+// PushEnabled reports whether peer accepts PUSH_PROMISE
+func (conn *Conn) PushEnabled() bool {
+	conn.settingsMu.Lock()
+	defer conn.settingsMu.Unlock()
+	return conn.PeerSettings.EnablePush()
+}
+
+// PushPromise sends PUSH_PROMISE with header on parent stream
+// and returns promised stream in RESERVED_LOCAL state.
+// promised stream id is even and allocated per connection,
+// push stops with ErrStreamIDExhausted when ids run out.
+func (conn *Conn) PushPromise(parent *Stream, header http.Header) (*Stream, error) {
+	// allocating id and sending PUSH_PROMISE are done in lock
+	// so that promised stream ids are sent in order
+	conn.openMu.Lock()
+	defer conn.openMu.Unlock()
+
+	if conn.GoingAway() {
+		return nil, fmt.Errorf("push after GOAWAY received")
+	}
+
+	if conn.ActiveStreams(false) >= conn.PeerSetting(SETTINGS_MAX_CONCURRENT_STREAMS) {
+		return nil, fmt.Errorf("pushed streams reached MAX_CONCURRENT_STREAMS")
+	}
+
+	promisedID, err := conn.NextStreamID()
+	if err != nil {
+		return nil, err
+	}
+
+	Debug("push promise stream(%d) on stream(%d)", promisedID, parent.ID)
+
+	// promised stream is reserved by sending PUSH_PROMISE
+	promised := NewStream(conn, promisedID, conn.CallBack)
+	promised.ChangeState(NewPushPromiseFrame(END_HEADERS, parent.ID, promisedID, nil, nil), SEND)
+	if err := conn.AddStream(promised); err != nil {
+		promised.Close()
+		return nil, err
+	}
+
+	// parent may be closed after state was checked,
+	// then promised stream is never known to peer
+	if err := parent.WritePushPromise(promisedID, header); err != nil {
+		promised.Close()
+		conn.closeStream(promised, closedByResetSent)
+		return nil, err
+	}
+
+	return promised, nil
+}
+
+// PushCallBack is called when PUSH_PROMISE received
+// with promised stream and promised request header.
+// returning false rejects the push.
+type PushCallBack func(promised *Stream, header http.Header) bool
+
+// ReadPushPromise reserves promised stream of PUSH_PROMISE,
+// and cancels it with RST_STREAM if push is rejected.
+func (conn *Conn) ReadPushPromise(frame *PushPromiseFrame) {
+	// pushed streams are limited by SETTINGS_MAX_CONCURRENT_STREAMS we advertised
+	refused := conn.ActiveStreams(false) >= conn.Setting(SETTINGS_MAX_CONCURRENT_STREAMS)
+
+	promised := NewStream(conn, frame.PromisedStreamID, nil)
+	promised.ChangeState(frame, RECV)
+	if err := conn.AddStream(promised); err != nil {
+		promised.Close()
+		return
+	}
+
+	// promised stream is the last stream initiated by peer
+	conn.mu.Lock()
+	conn.LastStreamID = promised.ID
+	conn.mu.Unlock()
+
+	if refused {
+		msg := "push over SETTINGS_MAX_CONCURRENT_STREAMS"
+		conn.ResetStream(promised, &StreamError{promised.ID, REFUSED_STREAM, msg})
+		return
+	}
+
+	// decoded from whole header block by conn
+	header := frame.Headers
+
+	if conn.PushCallBack == nil || !conn.PushCallBack(promised, header) {
+		conn.ResetStream(promised, &StreamError{promised.ID, CANCEL, "push rejected"})
+	}
+}
+
+// PushPolicy decides how Transport handles server push
+type PushPolicy int
+
+const (
+	// refuse all push with SETTINGS_ENABLE_PUSH=0
+	PushRefuse PushPolicy = iota
+	// accept push and deliver it to PushHandler and PushCache
+	PushAccept
+)
+
+// PushHandler is called with promised request and
+// its response when the response of accepted push arrived.
+type PushHandler func(req *http.Request, res *http.Response)
+
+// PushCallBack of Transport accepts push of GET/HEAD request
+// when PushHandler or PushCache can receive it.
+func (transport *Transport) PushCallBack(promised *Stream, header http.Header) bool {
+	if transport.PushPolicy != PushAccept {
+		return false
+	}
+
+	if transport.PushHandler == nil && transport.PushCache == nil {
+		return false
+	}
+
+	method := header.Get(":method")
+	if method != "GET" && method != "HEAD" {
+		Error("push of %q request", method)
+		return false
+	}
+
+	rawurl := fmt.Sprintf("%s://%s%s", header.Get(":scheme"), header.Get(":authority"), header.Get(":path"))
+	url, err := neturl.ParseRequestURI(rawurl)
+	if err != nil {
+		Error("%v", err)
+		return false
+	}
+
+	// server is authoritative only for origin of the connection,
+	// push for other origin would poison PushCache (RFC 7540 8.2)
+	origin, err := NewURL(rawurl)
+	if err != nil {
+		Error("%v", err)
+		return false
+	}
+	if origin.Scheme != "https" || origin.Host+":"+origin.Port != promised.Conn.authority {
+		Error("push of %s on connection to %s", rawurl, promised.Conn.authority)
+		return false
+	}
+
+	req := &http.Request{
+		Method:     method,
+		URL:        url,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Body:       http.NoBody,
+		Host:       url.Host,
+	}
+
+	// response of promised request comes on promised stream
+	callback, response := TransportCallBack(req)
+	promised.CallBack = callback
+
+	go func() {
+		// promised stream may be reset before its response
+		var res *http.Response
+		select {
+		case res = <-response:
+		case <-promised.done:
+			Debug("pushed stream(%d) was closed before response", promised.ID)
+			return
+		}
+		Notice("\n%s", White(util.ResponseString(res)))
+
+		if transport.PushCache != nil {
+			// cached body can be read only once, so keep copy
+			// and give another copy to handler.
+			// body too large to keep is not cached
+			limit := transport.PushCache.maxBodySize()
+			body, err := ioutil.ReadAll(io.LimitReader(res.Body, limit+1))
+			if err != nil {
+				res.Body.Close()
+				Error("%v", err)
+				return
+			}
+			if int64(len(body)) > limit {
+				Info("pushed body of %s over %d byte is not cached", req.URL, limit)
+				if transport.PushHandler == nil {
+					res.Body.Close()
+					return
+				}
+				rest := res.Body
+				res.Body = struct {
+					io.Reader
+					io.Closer
+				}{io.MultiReader(bytes.NewReader(body), rest), rest}
+				transport.PushHandler(req, res)
+				return
+			}
+			res.Body.Close()
+			res.Body = ioutil.NopCloser(bytes.NewReader(body))
+			transport.PushCache.Put(req, res)
+
+			if transport.PushHandler != nil {
+				copied := *res
+				copied.Body = ioutil.NopCloser(bytes.NewReader(body))
+				transport.PushHandler(req, &copied)
+			}
+			return
+		}
+
+		transport.PushHandler(req, res)
+	}()
+
+	return true
+}
+
+// defaults of PushCache
+const (
+	DefaultPushCacheEntries  = 100
+	DefaultPushCacheBodySize = 1 << 20
+	DefaultPushCacheTTL      = time.Minute
+)
+
+// PushCache keeps responses of accepted push
+// until matching request takes it, or it expires.
+// zero values of limits use defaults.
+type PushCache struct {
+	// responses kept at most, the oldest one is evicted over it
+	MaxEntries int
+	// body larger than it is not cached
+	MaxBodySize int64
+	// response not taken in TTL is evicted
+	TTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*pushCacheEntry
+}
+
+type pushCacheEntry struct {
+	res   *http.Response
+	added time.Time
+}
+
+func NewPushCache() *PushCache {
+	return &PushCache{
+		entries: make(map[string]*pushCacheEntry),
+	}
+}
+
+func (cache *PushCache) maxEntries() int {
+	if cache.MaxEntries > 0 {
+		return cache.MaxEntries
+	}
+	return DefaultPushCacheEntries
+}
+
+func (cache *PushCache) maxBodySize() int64 {
+	if cache.MaxBodySize > 0 {
+		return cache.MaxBodySize
+	}
+	return DefaultPushCacheBodySize
+}
+
+func (cache *PushCache) ttl() time.Duration {
+	if cache.TTL > 0 {
+		return cache.TTL
+	}
+	return DefaultPushCacheTTL
+}
+
+// key of request is method and url with port
+func (cache *PushCache) key(req *http.Request) string {
+	url, err := NewURL(req.URL.String())
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%s %s://%s:%s%s", req.Method, url.Scheme, url.Host, url.Port, url.RequestURI())
+}
+
+// Put keeps res for req, expired responses are evicted
+// and the oldest one is evicted if cache is full.
+func (cache *PushCache) Put(req *http.Request, res *http.Response) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	now := time.Now()
+	var oldest string
+	for key, entry := range cache.entries {
+		if now.Sub(entry.added) >= cache.ttl() {
+			delete(cache.entries, key)
+			continue
+		}
+		if oldest == "" || entry.added.Before(cache.entries[oldest].added) {
+			oldest = key
+		}
+	}
+
+	key := cache.key(req)
+	if _, ok := cache.entries[key]; !ok && len(cache.entries) >= cache.maxEntries() {
+		delete(cache.entries, oldest)
+	}
+	cache.entries[key] = &pushCacheEntry{res, now}
+}
+
+// Get returns and removes pushed response for req
+// or nil if not pushed or expired.
+func (cache *PushCache) Get(req *http.Request) *http.Response {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	key := cache.key(req)
+	entry, ok := cache.entries[key]
+	if !ok {
+		return nil
+	}
+	delete(cache.entries, key)
+	if time.Since(entry.added) >= cache.ttl() {
+		return nil
+	}
+	return entry.res
+}
@@ -0,0 +1,131 @@
+package http2
+
+import (
+	"github.com/Jxck/hpack"
+	. "github.com/Jxck/http2/frame"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// handler pushes resource with PUSH_PROMISE on the request stream
+// before its response, and the promised response follows on new stream.
+func TestServerPush(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			if err := w.(http.Pusher).Push("/style.css", nil); err != nil {
+				t.Error(err)
+			}
+		}
+		w.Write([]byte("body of " + r.URL.Path))
+	})
+	conn, done := testRawConnHandler(t, &Server{}, handler)
+	defer func() {
+		conn.Close()
+		<-done
+	}()
+	settings := map[SettingsID]int32{SETTINGS_MAX_FRAME_SIZE: DEFAULT_MAX_FRAME_SIZE}
+
+	NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, testHeaderBlock("/"), nil).Write(conn)
+
+	decoder := hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))
+	var promised uint32
+	bodies := map[uint32]string{}
+	for ends := 0; ends < 2; {
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		frame, err := ReadFrame(conn, settings)
+		if err != nil {
+			t.Fatalf("responses not received: %v", err)
+		}
+		switch f := frame.(type) {
+		case *GoAwayFrame:
+			t.Fatalf("closed with %v", f.ErrorCode)
+		case *RstStreamFrame:
+			t.Fatalf("got RST_STREAM %v for stream(%d)", f.ErrorCode, f.StreamID)
+		case *PushPromiseFrame:
+			decoder.Decode(f.HeaderBlockFragment)
+			header := decoder.ES.ToHeader()
+			if f.StreamID != 1 || header.Get(":path") != "/style.css" {
+				t.Errorf("got PUSH_PROMISE of %s on stream(%d)", header.Get(":path"), f.StreamID)
+			}
+			if _, ok := bodies[1]; ok {
+				t.Errorf("PUSH_PROMISE after response body")
+			}
+			promised = f.PromisedStreamID
+		case *HeadersFrame:
+			decoder.Decode(f.HeaderBlockFragment)
+			if f.StreamID != 1 && f.StreamID != promised {
+				t.Errorf("got HEADERS on stream(%d) before PUSH_PROMISE", f.StreamID)
+			}
+		case *DataFrame:
+			bodies[f.StreamID] += string(f.Data)
+			if f.Flags&END_STREAM == END_STREAM {
+				ends++
+			}
+		}
+	}
+
+	if promised != 2 {
+		t.Errorf("got promised stream(%d), want stream(2)", promised)
+	}
+	if bodies[1] != "body of /" || bodies[promised] != "body of /style.css" {
+		t.Errorf("got bodies %v", bodies)
+	}
+}
+
+// PUSH_PROMISE on stream closed after its state was checked
+// fails, and promised stream is never left on connection.
+func TestPushPromiseOnClosedStream(t *testing.T) {
+	conn := NewConn(nil)
+	defer conn.Close()
+	parent := NewStream(conn, 1, nil)
+	conn.AddStream(parent)
+	parent.Close()
+
+	header := http.Header{
+		":method":    {"GET"},
+		":path":      {"/style.css"},
+		":scheme":    {"https"},
+		":authority": {"example.com"},
+	}
+	promised, err := conn.PushPromise(parent, header)
+	if err == nil {
+		t.Fatalf("push on closed stream succeeded with stream(%d)", promised.ID)
+	}
+	if _, ok := conn.GetStream(2); ok {
+		t.Errorf("promised stream(2) is left on connection")
+	}
+	if conn.ActiveStreams(false) != 0 {
+		t.Errorf("promised stream is counted as active")
+	}
+}
+
+// pushed responses are kept up to MaxEntries and TTL
+func TestPushCache(t *testing.T) {
+	cache := NewPushCache()
+	cache.MaxEntries = 2
+	cache.TTL = time.Hour
+
+	request := func(path string) *http.Request {
+		req, _ := http.NewRequest("GET", "https://example.com"+path, nil)
+		return req
+	}
+	for _, path := range []string{"/1", "/2", "/3"} {
+		cache.Put(request(path), &http.Response{Status: path})
+	}
+	if res := cache.Get(request("/1")); res != nil {
+		t.Errorf("the oldest response is not evicted")
+	}
+	for _, path := range []string{"/2", "/3"} {
+		if res := cache.Get(request(path)); res == nil || res.Status != path {
+			t.Errorf("response of %s is not cached", path)
+		}
+	}
+
+	cache.TTL = time.Millisecond
+	cache.Put(request("/expired"), &http.Response{})
+	time.Sleep(10 * time.Millisecond)
+	if res := cache.Get(request("/expired")); res != nil {
+		t.Errorf("expired response is returned")
+	}
+}
@@ -1,23 +1,33 @@
 package http2
 
 import (
-	"bytes"
 	"fmt"
+	. "github.com/Jxck/color"
+	. "github.com/Jxck/http2/frame"
+	. "github.com/Jxck/logger"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
+// ResponseWriter implements http.ResponseWriter, http.Flusher
+// and http.Pusher on top of a Stream. HEADERS Frame is sent at the first
+// Write/WriteHeader and each Write is sent as DATA Frames
+// without buffering whole body.
 type ResponseWriter struct {
-	status int
-	header http.Header
-	body   *bytes.Buffer
+	status      int
+	header      http.Header
+	stream      *Stream
+	req         *http.Request
+	wroteHeader bool
+	trailers    []string
 }
 
-func NewResponseWriter() *ResponseWriter {
+func NewResponseWriter(stream *Stream) *ResponseWriter {
 	return &ResponseWriter{
 		status: 0,
 		header: make(http.Header),
-		body:   bytes.NewBuffer([]byte{}),
+		stream: stream,
 	}
 }
 
@@ -25,15 +35,125 @@ func (r *ResponseWriter) Header() http.Header {
 	return r.header
 }
 
+// Write sends b as DATA Frames.
+// it blocks while peer's flow control window is exhausted.
 func (r *ResponseWriter) Write(b []byte) (int, error) {
-	if r.status == 0 {
+	if !r.wroteHeader {
 		r.WriteHeader(http.StatusOK)
 	}
-	return r.body.Write(b)
+	if r.req != nil {
+		return r.stream.WriteDataContext(r.req.Context(), b, UNSET)
+	}
+	return r.stream.WriteData(b, UNSET)
 }
 
 func (r *ResponseWriter) WriteHeader(status int) {
+	if r.wroteHeader {
+		Error("multiple response.WriteHeader calls")
+		return
+	}
 	r.status = status
+	r.writeHeader(END_HEADERS)
+}
+
+// Flush implements http.Flusher.
+// DATA Frames are already sent at Write,
+// so only HEADERS Frame may remain unsent.
+func (r *ResponseWriter) Flush() {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+}
+
+// send response headers as HEADERS Frame
+// declared trailers are sent after body, not here.
+func (r *ResponseWriter) writeHeader(flags Flag) {
+	r.wroteHeader = true
+	r.trailers = r.declaredTrailers()
+
+	responseHeader := make(http.Header, len(r.header)+1)
+	for name, values := range r.header {
+		if r.isTrailer(name) {
+			continue
+		}
+		responseHeader[name] = values
+	}
+	responseHeader.Add(":status", strconv.Itoa(r.status))
+
+	Info("\n%s", Aqua((r.String())))
+
+	r.stream.WriteHeaders(responseHeader, flags)
+}
+
+// keys declared in Trailer header before WriteHeader
+func (r *ResponseWriter) declaredTrailers() (trailers []string) {
+	for _, names := range r.header["Trailer"] {
+		for _, name := range strings.Split(names, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name != "" {
+				trailers = append(trailers, name)
+			}
+		}
+	}
+	return trailers
+}
+
+func (r *ResponseWriter) isTrailer(name string) bool {
+	if strings.HasPrefix(name, http.TrailerPrefix) {
+		return true
+	}
+	for _, trailer := range r.trailers {
+		if trailer == name {
+			return true
+		}
+	}
+	return false
+}
+
+// trailer is value of declared keys and keys with
+// http.TrailerPrefix set by handler
+func (r *ResponseWriter) trailer() http.Header {
+	trailer := make(http.Header)
+	for _, name := range r.trailers {
+		if values := r.header[name]; len(values) > 0 {
+			trailer[name] = values
+		}
+	}
+	for name, values := range r.header {
+		if strings.HasPrefix(name, http.TrailerPrefix) {
+			name = http.CanonicalHeaderKey(strings.TrimPrefix(name, http.TrailerPrefix))
+			trailer[name] = values
+		}
+	}
+	return trailer
+}
+
+// finish ends the stream after handler returns.
+// if nothing has been written, HEADERS Frame carries END_STREAM,
+// if there are trailers, HEADERS Frame for them carries it,
+// otherwise empty DATA Frame does.
+func (r *ResponseWriter) finish() {
+	if !r.wroteHeader {
+		if r.status == 0 {
+			r.status = http.StatusOK
+		}
+		r.trailers = r.declaredTrailers()
+		if len(r.trailer()) == 0 {
+			r.writeHeader(END_HEADERS + END_STREAM)
+			return
+		}
+		r.writeHeader(END_HEADERS)
+	}
+
+	trailer := r.trailer()
+	if len(trailer) > 0 {
+		// End Stream in HEADERS Frame of trailers
+		r.stream.WriteHeaders(trailer, END_HEADERS+END_STREAM)
+		return
+	}
+
+	// End Stream in empty DATA Frame
+	r.stream.WriteData(nil, END_STREAM)
 }
 
 func (r ResponseWriter) String() (str string) {
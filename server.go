@@ -1,38 +1,221 @@
 package http2
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	. "github.com/Jxck/color"
-	"github.com/Jxck/hpack"
 	. "github.com/Jxck/http2/frame"
 	. "github.com/Jxck/logger"
 	"log"
 	"net"
 	"net/http"
 	neturl "net/url"
-	"strconv"
+	"sync"
+	"time"
 )
 
 func init() {
 	log.SetFlags(log.Lshortfile)
 }
 
+// Server has configuration of HTTP/2 connections
+// served by http.Server. zero value uses default settings.
+type Server struct {
+	// SETTINGS_MAX_CONCURRENT_STREAMS advertised to client.
+	// streams over it are refused with RST_STREAM REFUSED_STREAM.
+	// DEFAULT_MAX_CONCURRENT_STREAMS if 0.
+	MaxConcurrentStreams int32
+
+	// SETTINGS advertised to client, over DefaultSettings.
+	// MaxConcurrentStreams is preferred if both are set.
+	Settings Settings
+
+	// PING is sent when connection is idle for PingInterval,
+	// and connection is closed if its ACK does not come back within PingTimeout.
+	// keepalive is disabled if PingInterval is 0. PingTimeout is 15s if 0.
+	PingInterval time.Duration
+	PingTimeout  time.Duration
+
+	// connection is closed with GOAWAY when no stream is active for IdleTimeout,
+	// next frame doesn't come in ReadTimeout while client is sending requests,
+	// or header block is not completed in ReadHeaderTimeout.
+	// frame should be written in WriteTimeout.
+	// timeouts of http.Server are used if 0, and no timeout if both are 0.
+	IdleTimeout       time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	ReadHeaderTimeout time.Duration
+
+	// connection is closed with GOAWAY SETTINGS_TIMEOUT
+	// if client doesn't ACK SETTINGS in it. no timeout if 0.
+	SettingsTimeout time.Duration
+
+	// budgets of frames from client against resource exhaustion attacks,
+	// DefaultLimits are used for zero values.
+	Limits Limits
+
+	// http.Server.Shutdown waits streams to finish for ShutdownTimeout,
+	// because its ctx is not passed to RegisterOnShutdown.
+	// no timeout if 0, connections are closed by http.Server.Close.
+	ShutdownTimeout time.Duration
+
+	mu           sync.Mutex
+	conns        map[*Conn]struct{} // connections being served
+	shuttingDown bool
+}
+
+// ConfigureServer sets TLSNextProto of http.Server
+// to serve HTTP/2 connections with configuration of srv,
+// and http.Server.Shutdown shuts down them gracefully.
+func ConfigureServer(server *http.Server, srv *Server) {
+	if srv == nil {
+		srv = new(Server)
+	}
+	if server.TLSNextProto == nil {
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	server.TLSNextProto[VERSION] = srv.TLSNextProtoHandler
+
+	// http.Server.Shutdown waits until TLSNextProto returns,
+	// and closes connections by http.Server.Close
+	server.RegisterOnShutdown(func() {
+		ctx := context.Background()
+		if srv.ShutdownTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, srv.ShutdownTimeout)
+			defer cancel()
+		}
+		srv.Shutdown(ctx)
+	})
+}
+
+// Shutdown shuts down all connections gracefully
+// with GOAWAY, and waits in-flight streams finish.
+// when ctx is done, remaining connections are closed.
+// new connections after Shutdown are closed with GOAWAY.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	srv.shuttingDown = true
+	conns := make([]*Conn, 0, len(srv.conns))
+	for conn := range srv.conns {
+		conns = append(conns, conn)
+	}
+	srv.mu.Unlock()
+
+	Info("shutdown %d connections", len(conns))
+
+	errs := make(chan error, len(conns))
+	for _, conn := range conns {
+		go func(conn *Conn) {
+			errs <- conn.Shutdown(ctx)
+		}(conn)
+	}
+
+	var err error
+	for range conns {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// track adds conn to served connections,
+// or returns false while shutting down.
+func (srv *Server) track(conn *Conn) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.shuttingDown {
+		return false
+	}
+	if srv.conns == nil {
+		srv.conns = make(map[*Conn]struct{})
+	}
+	srv.conns[conn] = struct{}{}
+	return true
+}
+
+func (srv *Server) untrack(conn *Conn) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	delete(srv.conns, conn)
+}
+
 var TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){
 	VERSION: TLSNextProtoHandler,
 }
 
-var TLSNextProtoHandler = func(server *http.Server, conn *tls.Conn, handler http.Handler) {
+var TLSNextProtoHandler = new(Server).TLSNextProtoHandler
+
+func (srv *Server) TLSNextProtoHandler(server *http.Server, conn *tls.Conn, handler http.Handler) {
 	Notice(Yellow("New Connection from %s"), conn.RemoteAddr())
-	HandleTLSConnection(conn, handler)
+	srv.serveConn(conn, handler, server)
 	return // return closes connection
 }
 
 func HandleTLSConnection(conn net.Conn, handler http.Handler) {
+	new(Server).ServeConn(conn, handler)
+}
+
+// settings sent to client, and applied to connection
+func (srv *Server) settings() Settings {
+	settings := DefaultSettings.Clone()
+	settings.Merge(srv.Settings)
+	if srv.MaxConcurrentStreams > 0 {
+		settings[SETTINGS_MAX_CONCURRENT_STREAMS] = srv.MaxConcurrentStreams
+	}
+	return settings
+}
+
+// timeouts of srv, or of http.Server if not set
+// same as net/http, IdleTimeout and ReadHeaderTimeout
+// fall back to ReadTimeout.
+func (srv *Server) setTimeouts(conn *Conn, server *http.Server) {
+	conn.IdleTimeout = srv.IdleTimeout
+	conn.ReadTimeout = srv.ReadTimeout
+	conn.WriteTimeout = srv.WriteTimeout
+	conn.ReadHeaderTimeout = srv.ReadHeaderTimeout
+	if server == nil {
+		return
+	}
+
+	if conn.IdleTimeout == 0 {
+		conn.IdleTimeout = server.IdleTimeout
+		if conn.IdleTimeout == 0 {
+			conn.IdleTimeout = server.ReadTimeout
+		}
+	}
+	if conn.ReadTimeout == 0 {
+		conn.ReadTimeout = server.ReadTimeout
+	}
+	if conn.WriteTimeout == 0 {
+		conn.WriteTimeout = server.WriteTimeout
+	}
+	if conn.ReadHeaderTimeout == 0 {
+		conn.ReadHeaderTimeout = server.ReadHeaderTimeout
+		if conn.ReadHeaderTimeout == 0 {
+			conn.ReadHeaderTimeout = server.ReadTimeout
+		}
+	}
+}
+
+// ServeConn serves HTTP/2 on conn with handler
+// until connection is closed.
+func (srv *Server) ServeConn(conn net.Conn, handler http.Handler) {
+	srv.serveConn(conn, handler, nil)
+}
+
+// serveConn serves conn accepted by server,
+// which is nil if conn is not from http.Server.
+func (srv *Server) serveConn(conn net.Conn, handler http.Handler, server *http.Server) {
 	Info("Handle TLS Connection")
 	// do not call "defer conn.Close()" only retun function
 
 	Conn := NewConn(conn) // convert net.Conn to http2.Conn
+	srv.setTimeouts(Conn, server)
+	Conn.SettingsTimeout = srv.SettingsTimeout
+	Conn.Limits = srv.Limits
 
 	// http.Handler が req, res を必要とするので
 	// stream がそれを生成して、その stream を渡すことで
@@ -50,9 +233,26 @@ func HandleTLSConnection(conn net.Conn, handler http.Handler) {
 	// frame を書き込むループを回す
 	go Conn.WriteLoop()
 
-	// send default settings to id 0
-	settingsFrame := NewSettingsFrame(UNSET, 0, DefaultSettings)
-	Conn.WriteChan <- settingsFrame
+	// send settings of server to id 0
+	// they are applied when client ACKs
+	err = Conn.SendSettings(srv.settings())
+	if err != nil {
+		Error("%v", err)
+		Conn.Close()
+		return
+	}
+
+	if !srv.track(Conn) {
+		Info("refuse connection while shutting down")
+		Conn.WriteAndWait(NewGoAwayFrame(0, 0, NO_ERROR, nil))
+		Conn.Close()
+		return
+	}
+	defer srv.untrack(Conn)
+
+	if srv.PingInterval > 0 {
+		go Conn.KeepAlive(srv.PingInterval, srv.PingTimeout)
+	}
 
 	// 送られてきた frame を読み出すループを回す
 	// ここで block する。
@@ -70,13 +270,24 @@ func HandleTLSConnection(conn net.Conn, handler http.Handler) {
 }
 
 // handler を受け取って、将来 stream が渡されたら
-// その Bucket につめられた Headers/Data フレームから
-// req/res を作って handler を実行する関数を生成
+// その Bucket につめられた Headers から req/res を作って
+// handler を実行する関数を生成
+// Body は DATA フレームが届くたびに読める pipe になっている
 func HandlerCallBack(handler http.Handler) CallBack {
 	return func(stream *Stream) {
 		header := stream.Bucket.Headers
 		body := stream.Bucket.Body
 
+		// request without exactly one of each pseudo header
+		// is malformed (RFC 7540 8.1.2.3)
+		for _, name := range []string{":method", ":path", ":scheme"} {
+			if len(header[name]) != 1 || header[name][0] == "" {
+				msg := fmt.Sprintf("malformed request, %s pseudo header is missing or duplicated", name)
+				stream.Conn.ResetStream(stream, &StreamError{stream.ID, PROTOCOL_ERROR, msg})
+				return
+			}
+		}
+
 		authority := header.Get(":authority")
 		method := header.Get(":method")
 		path := header.Get(":path")
@@ -90,7 +301,9 @@ func HandlerCallBack(handler http.Handler) CallBack {
 		rawurl := fmt.Sprintf("%s://%s%s", scheme, authority, path)
 		url, err := neturl.ParseRequestURI(rawurl)
 		if err != nil {
-			Fatal("%v", err)
+			msg := fmt.Sprintf("malformed request, %v", err)
+			stream.Conn.ResetStream(stream, &StreamError{stream.ID, PROTOCOL_ERROR, msg})
+			return
 		}
 
 		req := &http.Request{
@@ -101,78 +314,29 @@ func HandlerCallBack(handler http.Handler) CallBack {
 			ProtoMinor:       1,
 			Header:           header,
 			Body:             body,
-			ContentLength:    int64(body.Buffer.Len()),
+			ContentLength:    util.ContentLength(header),
+			Trailer:          stream.Bucket.Trailer,
 			TransferEncoding: []string{}, // TODO:
 			Close:            false,
 			Host:             authority,
 		}
 
+		// handler can stop when stream was reset or connection was closed
+		ctx, cancel := stream.newContext(context.Background())
+		defer cancel()
+		req = req.WithContext(ctx)
+
 		Info("\n%s", Lime(util.RequestString(req)))
 
 		// Handle HTTP using handler
-		res := NewResponseWriter()
+		// response is sent to stream while handler writes it
+		res := NewResponseWriter(stream)
+		res.req = req
 		handler.ServeHTTP(res, req)
-		responseHeader := res.Header()
-		responseHeader.Add(":status", strconv.Itoa(res.status))
-
-		Info("\n%s", Aqua((res.String())))
-
-		// Send response headers as HEADERS Frame
-		headerList := hpack.ToHeaderList(responseHeader)
-		headerBlockFragment := stream.HpackContext.Encode(*headerList)
-		Debug("%v", headerList)
-
-		headersFrame := NewHeadersFrame(END_HEADERS, stream.ID, nil, headerBlockFragment, nil)
-		headersFrame.Headers = responseHeader
-
-		stream.Write(headersFrame)
-
-		// Send response body as DATA Frame
-		// each DataFrame has data in window size
-		data := res.body.Bytes()
-		maxFrameSize := stream.PeerSettings[SETTINGS_MAX_FRAME_SIZE]
-		rest := int32(len(data))
-		frameSize := rest
-
-		// MaxFrameSize を基準に考え、そこから送れるサイズまで減らして行く
-		for {
-			Debug("rest data size(%v), current peer(%v) window(%v)", rest, stream.ID, stream.Window)
-
-			// 送り終わってれば終わり
-			if rest == 0 {
-				break
-			}
-
-			frameSize = stream.Window.Consumable(rest)
-
-			if frameSize <= 0 {
-				continue
-			}
-
-			// MaxFrameSize より大きいなら切り詰める
-			if frameSize > maxFrameSize {
-				frameSize = maxFrameSize
-			}
-
-			Debug("send %v/%v data", frameSize, rest)
-
-			// ここまでに算出した frameSize 分のデータを DATA Frame を作って送る
-			dataToSend := make([]byte, frameSize)
-			copy(dataToSend, data[:frameSize])
-			dataFrame := NewDataFrame(UNSET, stream.ID, dataToSend, nil)
-			stream.Write(dataFrame)
-
-			// 送った分を削る
-			rest -= frameSize
-			copy(data, data[frameSize:])
-			data = data[:rest]
-
-			// Peer の Window Size を減らす
-			stream.Window.ConsumePeer(frameSize)
-		}
+		res.finish()
 
-		// End Stream in empty DATA Frame
-		endDataFrame := NewDataFrame(END_STREAM, stream.ID, nil, nil)
-		stream.Write(endDataFrame)
+		// body which handler didn't read is discarded,
+		// and its window is released for other streams
+		body.Close()
 	}
 }
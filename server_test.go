@@ -0,0 +1,413 @@
+package http2
+
+import (
+	"context"
+	"fmt"
+	"github.com/Jxck/hpack"
+	. "github.com/Jxck/http2/frame"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// request body which handler didn't read releases
+// connection window after handler returned.
+func TestUnreadBody(t *testing.T) {
+	conn, done := testRawConn(t, &Server{})
+	defer func() {
+		conn.Close()
+		<-done
+	}()
+	settings := map[SettingsID]int32{SETTINGS_MAX_FRAME_SIZE: DEFAULT_MAX_FRAME_SIZE}
+
+	const length = 20000
+	encoder := hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))
+	for streamID := uint32(1); streamID <= 5; streamID += 2 {
+		header := http.Header{
+			":method":        {"POST"},
+			":path":          {"/"},
+			":scheme":        {"https"},
+			":authority":     {"example.com"},
+			"content-length": {fmt.Sprint(length)},
+		}
+		NewHeadersFrame(END_HEADERS, streamID, nil, encoder.Encode(*hpack.ToHeaderList(header)), nil).Write(conn)
+		NewDataFrame(UNSET, streamID, make([]byte, DEFAULT_MAX_FRAME_SIZE), nil).Write(conn)
+		NewDataFrame(END_STREAM, streamID, make([]byte, length-DEFAULT_MAX_FRAME_SIZE), nil).Write(conn)
+	}
+
+	// 60000 byte of 65535 was sent, so window should be updated
+	var update uint32
+	for update == 0 {
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		frame, err := ReadFrame(conn, settings)
+		if err != nil {
+			t.Fatalf("connection window was not updated: %v", err)
+		}
+		switch f := frame.(type) {
+		case *GoAwayFrame:
+			t.Fatalf("closed with %v", f.ErrorCode)
+		case *WindowUpdateFrame:
+			if f.StreamID == 0 {
+				update += f.WindowSizeIncrement
+			}
+		}
+	}
+}
+
+// context of request is canceled when peer reset the stream,
+// so that handler can stop.
+func TestRequestContext(t *testing.T) {
+	canceled := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			close(canceled)
+		case <-time.After(3 * time.Second):
+		}
+	})
+	conn, done := testRawConnHandler(t, &Server{}, handler)
+	defer func() {
+		conn.Close()
+		<-done
+	}()
+
+	NewHeadersFrame(END_HEADERS, 1, nil, testHeaderBlock("/"), nil).Write(conn)
+	NewRstStreamFrame(1, CANCEL).Write(conn)
+
+	select {
+	case <-canceled:
+	case <-time.After(3 * time.Second):
+		t.Fatal("context of request was not canceled by RST_STREAM")
+	}
+}
+
+// stream reset by peer counts toward MAX_CONCURRENT_STREAMS
+// until its handler returns, against Rapid Reset (CVE-2023-44487).
+func TestResetStreamHandler(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})
+	srv := &Server{Settings: Settings{SETTINGS_MAX_CONCURRENT_STREAMS: 1}}
+	conn, done := testRawConnHandler(t, srv, handler)
+	defer func() {
+		conn.Close()
+		<-done
+	}()
+	settings := map[SettingsID]int32{SETTINGS_MAX_FRAME_SIZE: DEFAULT_MAX_FRAME_SIZE}
+
+	NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, testHeaderBlock("/"), nil).Write(conn)
+	<-started
+	NewRstStreamFrame(1, CANCEL).Write(conn)
+	NewHeadersFrame(END_STREAM+END_HEADERS, 3, nil, testHeaderBlock("/"), nil).Write(conn)
+
+	for refused := false; !refused; {
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		frame, err := ReadFrame(conn, settings)
+		if err != nil {
+			t.Fatalf("stream(3) was not refused: %v", err)
+		}
+		switch f := frame.(type) {
+		case *GoAwayFrame:
+			t.Fatalf("closed with %v", f.ErrorCode)
+		case *HeadersFrame:
+			t.Fatalf("stream(%d) was accepted while handler of stream(1) is running", f.StreamID)
+		case *RstStreamFrame:
+			if f.StreamID != 3 || f.ErrorCode != REFUSED_STREAM {
+				t.Fatalf("got RST_STREAM %v for stream(%d), want REFUSED_STREAM for stream(3)", f.ErrorCode, f.StreamID)
+			}
+			refused = true
+		}
+	}
+
+	// slot is released when handler returned
+	close(release)
+	time.Sleep(100 * time.Millisecond)
+	NewHeadersFrame(END_STREAM+END_HEADERS, 5, nil, testHeaderBlock("/"), nil).Write(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		frame, err := ReadFrame(conn, settings)
+		if err != nil {
+			t.Fatalf("stream(5) was not accepted: %v", err)
+		}
+		switch f := frame.(type) {
+		case *GoAwayFrame:
+			t.Fatalf("closed with %v", f.ErrorCode)
+		case *RstStreamFrame:
+			t.Fatalf("got RST_STREAM %v for stream(%d)", f.ErrorCode, f.StreamID)
+		case *HeadersFrame:
+			if f.StreamID == 5 {
+				return
+			}
+		}
+	}
+}
+
+// malformed request resets only the stream with PROTOCOL_ERROR
+func TestMalformedRequest(t *testing.T) {
+	var cases = []struct {
+		name   string
+		header http.Header
+	}{
+		{"missing :path", http.Header{":method": {"GET"}, ":scheme": {"https"}, ":authority": {"example.com"}}},
+		{"missing :method", http.Header{":path": {"/"}, ":scheme": {"https"}, ":authority": {"example.com"}}},
+		{"duplicated :path", http.Header{":method": {"GET"}, ":path": {"/", "/a"}, ":scheme": {"https"}, ":authority": {"example.com"}}},
+		{"invalid :path", http.Header{":method": {"GET"}, ":path": {"/%zz"}, ":scheme": {"https"}, ":authority": {"example.com"}}},
+	}
+	settings := map[SettingsID]int32{SETTINGS_MAX_FRAME_SIZE: DEFAULT_MAX_FRAME_SIZE}
+
+	for _, c := range cases {
+		conn, done := testRawConn(t, &Server{})
+		encoder := hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))
+		NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, encoder.Encode(*hpack.ToHeaderList(c.header)), nil).Write(conn)
+
+		for reset := false; !reset; {
+			conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+			frame, err := ReadFrame(conn, settings)
+			if err != nil {
+				t.Fatalf("%s: RST_STREAM not received: %v", c.name, err)
+			}
+			switch f := frame.(type) {
+			case *GoAwayFrame:
+				t.Fatalf("%s: closed with %v", c.name, f.ErrorCode)
+			case *HeadersFrame:
+				t.Fatalf("%s: got response", c.name)
+			case *RstStreamFrame:
+				if f.StreamID != 1 || f.ErrorCode != PROTOCOL_ERROR {
+					t.Errorf("%s: got RST_STREAM %v for stream(%d), want PROTOCOL_ERROR", c.name, f.ErrorCode, f.StreamID)
+				}
+				reset = true
+			}
+		}
+		conn.Close()
+		<-done
+	}
+}
+
+// Shutdown sends GOAWAY with max stream id and PING,
+// then the final GOAWAY with last stream id after ACK,
+// or after shutdownPingTimeout if ACK doesn't come.
+func TestShutdown(t *testing.T) {
+	defer func(timeout time.Duration) {
+		shutdownPingTimeout = timeout
+	}(shutdownPingTimeout)
+	shutdownPingTimeout = 200 * time.Millisecond
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	settings := map[SettingsID]int32{SETTINGS_MAX_FRAME_SIZE: DEFAULT_MAX_FRAME_SIZE}
+
+	for _, ack := range []bool{true, false} {
+		srv := &Server{}
+		conn, done := testRawConnHandler(t, srv, handler)
+
+		// response ensures connection is served
+		NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, testHeaderBlock("/"), nil).Write(conn)
+		for end := false; !end; {
+			conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+			frame, err := ReadFrame(conn, settings)
+			if err != nil {
+				t.Fatal(err)
+			}
+			end = frame.Header().StreamID == 1 && frame.Header().Flags&END_STREAM == END_STREAM
+		}
+
+		shutdown := make(chan error)
+		go func() {
+			shutdown <- srv.Shutdown(context.Background())
+		}()
+
+		var goaways []uint32
+		for len(goaways) < 2 {
+			conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+			frame, err := ReadFrame(conn, settings)
+			if err != nil {
+				t.Fatalf("ack(%v): final GOAWAY not received: %v", ack, err)
+			}
+			switch f := frame.(type) {
+			case *GoAwayFrame:
+				if f.ErrorCode != NO_ERROR {
+					t.Fatalf("ack(%v): closed with %v", ack, f.ErrorCode)
+				}
+				goaways = append(goaways, f.LastStreamID)
+			case *PingFrame:
+				if len(goaways) != 1 {
+					t.Errorf("ack(%v): PING before first GOAWAY", ack)
+				}
+				if ack && f.Flags&ACK == 0 {
+					NewPingFrame(ACK, 0, f.OpaqueData).Write(conn)
+				}
+			}
+		}
+		if goaways[0] != MAX_STREAM_ID || goaways[1] != 1 {
+			t.Errorf("ack(%v): got last stream id %v, want [%d 1]", ack, goaways, MAX_STREAM_ID)
+		}
+
+		select {
+		case err := <-shutdown:
+			if err != nil {
+				t.Errorf("ack(%v): %v", ack, err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Errorf("ack(%v): Shutdown did not return", ack)
+		}
+		conn.Close()
+		<-done
+	}
+}
+
+// trailers of request are seen by handler after body,
+// and trailers declared by handler are sent in HEADERS with END_STREAM.
+func TestTrailers(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Result")
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		w.Write(body)
+		w.Header().Set("X-Result", r.Trailer.Get("X-Checksum"))
+	})
+	conn, done := testRawConnHandler(t, &Server{}, handler)
+	defer func() {
+		conn.Close()
+		<-done
+	}()
+	settings := map[SettingsID]int32{SETTINGS_MAX_FRAME_SIZE: DEFAULT_MAX_FRAME_SIZE}
+
+	encoder := hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))
+	header := http.Header{
+		":method":    {"POST"},
+		":path":      {"/"},
+		":scheme":    {"https"},
+		":authority": {"example.com"},
+		"trailer":    {"x-checksum"},
+	}
+	trailer := http.Header{"x-checksum": {"abc"}}
+	NewHeadersFrame(END_HEADERS, 1, nil, encoder.Encode(*hpack.ToHeaderList(header)), nil).Write(conn)
+	NewDataFrame(UNSET, 1, []byte("hello"), nil).Write(conn)
+	NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, encoder.Encode(*hpack.ToHeaderList(trailer)), nil).Write(conn)
+
+	decoder := hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))
+	var blocks []http.Header
+	var body string
+	for end := false; !end; {
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		frame, err := ReadFrame(conn, settings)
+		if err != nil {
+			t.Fatalf("response not received: %v", err)
+		}
+		switch f := frame.(type) {
+		case *GoAwayFrame:
+			t.Fatalf("closed with %v", f.ErrorCode)
+		case *RstStreamFrame:
+			t.Fatalf("got RST_STREAM %v", f.ErrorCode)
+		case *HeadersFrame:
+			decoder.Decode(f.HeaderBlockFragment)
+			blocks = append(blocks, decoder.ES.ToHeader())
+			end = f.Flags&END_STREAM == END_STREAM
+		case *DataFrame:
+			if f.Flags&END_STREAM == END_STREAM {
+				t.Fatalf("END_STREAM in DATA before trailers")
+			}
+			body += string(f.Data)
+		}
+	}
+
+	if len(blocks) != 2 {
+		t.Fatalf("got %d header blocks, want headers and trailers", len(blocks))
+	}
+	if got := blocks[0].Get("X-Result"); got != "" {
+		t.Errorf("trailer %q is sent in headers", got)
+	}
+	if body != "hello" {
+		t.Errorf("got body %q, want %q", body, "hello")
+	}
+	if got := blocks[1].Get("X-Result"); got != "abc" {
+		t.Errorf("got trailer %q, want %q", got, "abc")
+	}
+}
+
+// PING is sent to idle connection for keepalive,
+// and connection is closed when its ACK doesn't come in PingTimeout.
+func TestKeepAlive(t *testing.T) {
+	srv := &Server{PingInterval: 50 * time.Millisecond, PingTimeout: 100 * time.Millisecond}
+	conn, done := testRawConn(t, srv)
+	defer conn.Close()
+	settings := map[SettingsID]int32{SETTINGS_MAX_FRAME_SIZE: DEFAULT_MAX_FRAME_SIZE}
+
+	// connection is kept while PING is acknowledged
+	pings := 0
+	for deadline := time.Now().Add(300 * time.Millisecond); time.Now().Before(deadline); {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		frame, err := ReadFrame(conn, settings)
+		if err != nil {
+			t.Fatalf("connection was closed while PING is acknowledged: %v", err)
+		}
+		if f, ok := frame.(*PingFrame); ok && f.Flags&ACK == 0 {
+			pings++
+			NewPingFrame(ACK, 0, f.OpaqueData).Write(conn)
+		}
+	}
+	if pings == 0 {
+		t.Fatalf("PING was not sent to idle connection")
+	}
+
+	// connection is closed without ACK
+	for {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := ReadFrame(conn, settings); err != nil {
+			break
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("connection was not closed without PING ACK")
+	}
+}
+
+// connection without active stream for IdleTimeout
+// is closed with GOAWAY NO_ERROR.
+func TestIdleTimeout(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("ok"))
+	})
+	conn, done := testRawConnHandler(t, &Server{IdleTimeout: 100 * time.Millisecond}, handler)
+	defer conn.Close()
+	settings := map[SettingsID]int32{SETTINGS_MAX_FRAME_SIZE: DEFAULT_MAX_FRAME_SIZE}
+
+	// active stream longer than IdleTimeout keeps connection
+	NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, testHeaderBlock("/"), nil).Write(conn)
+	var goaway *GoAwayFrame
+	for responded := false; goaway == nil; {
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		frame, err := ReadFrame(conn, settings)
+		if err != nil {
+			t.Fatalf("GOAWAY not received: %v", err)
+		}
+		switch f := frame.(type) {
+		case *GoAwayFrame:
+			if !responded {
+				t.Fatalf("closed with %v while stream is active", f.ErrorCode)
+			}
+			goaway = f
+		case *DataFrame:
+			responded = responded || f.Flags&END_STREAM == END_STREAM
+		}
+	}
+	if goaway.ErrorCode != NO_ERROR || goaway.LastStreamID != 1 {
+		t.Errorf("got GOAWAY %v last stream(%d), want NO_ERROR last stream(1)", goaway.ErrorCode, goaway.LastStreamID)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("idle connection was not closed")
+	}
+}
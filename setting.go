@@ -1,6 +1,7 @@
 package http2
 
 import (
+	"fmt"
 	. "github.com/Jxck/http2/frame"
 )
 
@@ -9,9 +10,25 @@ const (
 	OVER_TCP                  = "h2c"
 	VERSION                   = OVER_TLS
 	CONNECTION_PREFACE        = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+	// max size of header block which is buffered
+	// from HEADERS/PUSH_PROMISE and CONTINUATION Frames
+	DEFAULT_MAX_HEADER_BLOCK_SIZE = 1 << 20
+
+	// stream identifier is 31 bit
+	MAX_STREAM_ID uint32 = 1<<31 - 1
+
+	// SETTINGS_HEADER_TABLE_SIZE can not exceed it
+	MAX_HEADER_TABLE_SIZE uint32 = 1<<31 - 1
 )
 
-var DefaultSettings = map[SettingsID]int32{
+// Settings are SETTINGS parameters of one endpoint of connection.
+// each connection has its own Settings for both endpoints.
+type Settings map[SettingsID]int32
+
+// initial values of SETTINGS (RFC 7540 6.5.2), used until SETTINGS arrives.
+// do not modify, copy it with Clone.
+var DefaultSettings = Settings{
 	SETTINGS_HEADER_TABLE_SIZE: DEFAULT_HEADER_TABLE_SIZE,
 	// SETTINGS_ENABLE_PUSH:            DEFAULT_ENABLE_PUSH, // server dosen't send this
 	SETTINGS_MAX_CONCURRENT_STREAMS: DEFAULT_MAX_CONCURRENT_STREAMS,
@@ -21,3 +38,84 @@ var DefaultSettings = map[SettingsID]int32{
 }
 
 var NilSettings = make(map[SettingsID]int32, 0)
+
+// Clone returns copy of settings
+func (settings Settings) Clone() Settings {
+	clone := make(Settings, len(settings))
+	for id, value := range settings {
+		clone[id] = value
+	}
+	return clone
+}
+
+// Merge overwrites settings with values in other
+func (settings Settings) Merge(other Settings) {
+	for id, value := range other {
+		settings[id] = value
+	}
+}
+
+// value of id, or initial value if not set
+func (settings Settings) value(id SettingsID, initial int32) int32 {
+	value, ok := settings[id]
+	if !ok {
+		return initial
+	}
+	return value
+}
+
+func (settings Settings) HeaderTableSize() uint32 {
+	return uint32(settings.value(SETTINGS_HEADER_TABLE_SIZE, DEFAULT_HEADER_TABLE_SIZE))
+}
+
+func (settings Settings) EnablePush() bool {
+	return settings.value(SETTINGS_ENABLE_PUSH, DEFAULT_ENABLE_PUSH) == 1
+}
+
+// values over 2^31-1 are treated as 2^31-1
+func (settings Settings) MaxConcurrentStreams() int32 {
+	value := settings.value(SETTINGS_MAX_CONCURRENT_STREAMS, DEFAULT_MAX_CONCURRENT_STREAMS)
+	if value < 0 {
+		return 1<<31 - 1
+	}
+	return value
+}
+
+func (settings Settings) InitialWindowSize() int32 {
+	return settings.value(SETTINGS_INITIAL_WINDOW_SIZE, DEFAULT_INITIAL_WINDOW_SIZE)
+}
+
+func (settings Settings) MaxFrameSize() int32 {
+	return settings.value(SETTINGS_MAX_FRAME_SIZE, DEFAULT_MAX_FRAME_SIZE)
+}
+
+func (settings Settings) MaxHeaderListSize() int32 {
+	value := settings.value(SETTINGS_MAX_HEADER_LIST_SIZE, DEFAULT_MAX_HEADER_LIST_SIZE)
+	if value < 0 {
+		return 1<<31 - 1
+	}
+	return value
+}
+
+// Validate checks values of settings (RFC 7540 6.5.2).
+// error is connection error to be sent with GOAWAY.
+// unknown settings are ignored.
+func (settings Settings) Validate() *H2Error {
+	if value, ok := settings[SETTINGS_ENABLE_PUSH]; ok && value != 0 && value != 1 {
+		msg := fmt.Sprintf("SETTINGS_ENABLE_PUSH should be 0 or 1 but %d", value)
+		return &H2Error{PROTOCOL_ERROR, msg}
+	}
+
+	// values over 2^31-1 are negative in int32
+	if value, ok := settings[SETTINGS_INITIAL_WINDOW_SIZE]; ok && value < 0 {
+		msg := fmt.Sprintf("SETTINGS_INITIAL_WINDOW_SIZE %d is over 2^31-1", uint32(value))
+		return &H2Error{FLOW_CONTROL_ERROR, msg}
+	}
+
+	if value, ok := settings[SETTINGS_MAX_FRAME_SIZE]; ok && (value < DEFAULT_MAX_FRAME_SIZE || value > 1<<24-1) {
+		msg := fmt.Sprintf("SETTINGS_MAX_FRAME_SIZE should be between 2^14 and 2^24-1 but %d", uint32(value))
+		return &H2Error{PROTOCOL_ERROR, msg}
+	}
+
+	return nil
+}
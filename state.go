@@ -89,7 +89,14 @@ func (c Context) String() string {
 //     PP: PUSH_PROMISE frame (with implied CONTINUATIONs)
 //     ES: END_STREAM flag
 //     R:  RST_STREAM frame
+//
+// ChangeState is called from goroutines which send or receive frame
+// so transition is done in lock of stream.
+// frames for closed stream are StreamError (STREAM_CLOSED),
+// other invalid transitions are connection error (PROTOCOL_ERROR).
 func (stream *Stream) ChangeState(frame Frame, context Context) (err error) {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
 
 	header := frame.Header()
 	types := header.Type
@@ -159,6 +166,11 @@ func (stream *Stream) ChangeState(frame Frame, context Context) (err error) {
 		// H
 		if types == HeadersFrameType && context == SEND {
 			stream.changeState(HALF_CLOSED_REMOTE)
+
+			// ES
+			if flags&END_STREAM == END_STREAM {
+				stream.changeState(CLOSED)
+			}
 			return
 		}
 
@@ -171,6 +183,11 @@ func (stream *Stream) ChangeState(frame Frame, context Context) (err error) {
 		// H
 		if types == HeadersFrameType && context == RECV {
 			stream.changeState(HALF_CLOSED_LOCAL)
+
+			// ES
+			if flags&END_STREAM == END_STREAM {
+				stream.changeState(CLOSED)
+			}
 			return
 		}
 
@@ -247,7 +264,7 @@ func (stream *Stream) ChangeState(frame Frame, context Context) (err error) {
 
 			msg := fmt.Sprintf("invalid frame type %v at %v state", types, state)
 			Error(Red(msg))
-			return &H2Error{STREAM_CLOSED, msg}
+			return &StreamError{stream.ID, STREAM_CLOSED, msg}
 		}
 	case CLOSED:
 
@@ -269,7 +286,7 @@ func (stream *Stream) ChangeState(frame Frame, context Context) (err error) {
 
 			msg := fmt.Sprintf("invalid frame type %v at %v state", types, state)
 			Error(Red(msg))
-			return &H2Error{STREAM_CLOSED, msg}
+			return &StreamError{stream.ID, STREAM_CLOSED, msg}
 		}
 	}
 
@@ -278,6 +295,7 @@ func (stream *Stream) ChangeState(frame Frame, context Context) (err error) {
 	return &H2Error{PROTOCOL_ERROR, msg}
 }
 
+// caller should hold stream.mu
 func (stream *Stream) changeState(state State) {
 	Info("change stream (%d) state (%s -> %s)", stream.ID, stream.State, Pink(state.String()))
 	stream.State = state
@@ -1,59 +1,90 @@
 package http2
 
 import (
-	"github.com/Jxck/hpack"
+	"context"
+	"fmt"
 	. "github.com/Jxck/http2/frame"
 	. "github.com/Jxck/logger"
+	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 func init() {
 	log.SetFlags(log.Lshortfile)
 }
 
+// Stream is used from several goroutines.
+// frames are read only by ReadLoop of stream,
+// State and Closed are changed in lock of mu,
+// and Window has its own lock.
 type Stream struct {
-	ID           uint32
-	State        State
-	Window       *Window
-	ReadChan     chan Frame
-	WriteChan    chan Frame
-	Settings     map[SettingsID]int32
-	PeerSettings map[SettingsID]int32
-	HpackContext *hpack.Context
-	CallBack     CallBack
-	Bucket       *Bucket
-	Closed       bool
+	ID             uint32
+	State          State
+	Window         *Window
+	ReadChan       chan Frame
+	CallBack       CallBack
+	Bucket         *Bucket
+	Closed         bool
+	Conn           *Conn
+	headerReceived bool
+	called         bool // CallBack was called, used only in ReadLoop
+
+	// content-length of header and length of DATA received,
+	// checked only in conn.ReadLoop. -1 if unknown.
+	contentLength  int64
+	receivedLength int64
+
+	mu   sync.Mutex    // protects State, Closed and err
+	done chan struct{} // closed when stream is closed
+	err  error         // reason of close
+
+	// finished is closed when stream was removed from conn,
+	// and stopped is closed when ReadLoop returned.
+	finished   chan struct{}
+	finishOnce sync.Once
+	stopped    chan struct{}
+
+	// frames are written in lock of writeMu, so that
+	// no frame is written after RST_STREAM
+	writeMu sync.Mutex
 }
 
 type Bucket struct {
 	Headers http.Header
+	Trailer http.Header
 	Body    *Body
 }
 
-func NewBucket() *Bucket {
+func NewBucket(body *Body) *Bucket {
 	return &Bucket{
 		Headers: make(http.Header),
-		Body:    new(Body),
+		Trailer: make(http.Header),
+		Body:    body,
 	}
 }
 
 type CallBack func(stream *Stream)
 
-func NewStream(id uint32, writeChan chan Frame, settings, peerSettings map[SettingsID]int32, hpackContext *hpack.Context, callback CallBack) *Stream {
+func NewStream(conn *Conn, id uint32, callback CallBack) *Stream {
 	stream := &Stream{
-		ID:           id,
-		State:        IDLE,
-		Window:       NewWindow(settings[SETTINGS_INITIAL_WINDOW_SIZE], peerSettings[SETTINGS_INITIAL_WINDOW_SIZE]),
-		ReadChan:     make(chan Frame),
-		WriteChan:    writeChan,
-		Settings:     settings,
-		PeerSettings: peerSettings,
-		HpackContext: hpackContext,
-		CallBack:     callback,
-		Bucket:       NewBucket(),
-		Closed:       false,
+		ID:       id,
+		State:    IDLE,
+		Window:   NewWindow(conn.Setting(SETTINGS_INITIAL_WINDOW_SIZE), conn.PeerSetting(SETTINGS_INITIAL_WINDOW_SIZE)),
+		ReadChan: make(chan Frame),
+		CallBack: callback,
+		Closed:   false,
+		Conn:     conn,
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+		stopped:  make(chan struct{}),
+
+		contentLength: -1,
 	}
+	stream.Bucket = NewBucket(NewBody(stream.ReadBody))
 	go stream.ReadLoop()
 	return stream
 }
@@ -63,30 +94,24 @@ func (stream *Stream) Read(f Frame) {
 
 	switch frame := f.(type) {
 	case *HeadersFrame:
-		// Decode Headers
-		header := stream.DecodeHeader(frame.HeaderBlockFragment)
-		frame.Headers = header
-
-		for name, values := range header {
-			for _, value := range values {
-				stream.Bucket.Headers.Add(name, value)
-			}
-		}
-
-		if frame.Header().Flags&END_STREAM == END_STREAM {
-			go stream.CallBack(stream)
-		}
+		// Headers are decoded from whole header block by conn
+		stream.ReadHeader(frame.Headers, frame.Header().Flags)
 	case *DataFrame:
+		// padding is never read from body
+		// so WINDOW_UPDATE for it immediately
 		length := int32(frame.Header().Length)
-		stream.WindowUpdate(length)
+		if padding := length - int32(len(frame.Data)); padding > 0 {
+			stream.WindowUpdate(padding)
+			stream.Conn.WindowConsume(padding)
+		}
 
 		_, err := stream.Bucket.Body.Write(frame.Data)
 		if err != nil {
-			Fatal("%v", err)
+			Error("%v", err)
 		}
 
 		if frame.Header().Flags&END_STREAM == END_STREAM {
-			stream.CallBack(stream)
+			stream.Bucket.Body.CloseWithError(io.EOF)
 		}
 	case *RstStreamFrame:
 		Debug("close stream by RST_STREAM")
@@ -99,38 +124,316 @@ func (stream *Stream) Read(f Frame) {
 	case *WindowUpdateFrame:
 		Info("Window Update %d byte stream(%v)", frame.WindowSizeIncrement, stream.ID)
 		stream.Window.UpdatePeer(int32(frame.WindowSizeIncrement))
-	case *ContinuationFrame:
-		// Decode Headers
-		header := stream.DecodeHeader(frame.HeaderBlockFragment)
-		frame.Headers = header
-
-		for name, values := range header {
-			for _, value := range values {
-				stream.Bucket.Headers.Add(name, value)
+	}
+}
+
+// ReadHeader adds header to Bucket, and calls CallBack
+// when header block ended so that handler starts
+// before the body arrives.
+func (stream *Stream) ReadHeader(header http.Header, flags Flag) {
+	// header block after headers is trailers
+	if stream.headerReceived {
+		stream.ReadTrailer(header, flags)
+		return
+	}
+
+	for name, values := range header {
+		for _, value := range values {
+			stream.Bucket.Headers.Add(name, value)
+		}
+	}
+
+	if flags&END_HEADERS == END_HEADERS {
+		stream.headerReceived = true
+
+		// keys of trailer are declared in Trailer header
+		// and values are filled when trailers arrive
+		for _, names := range stream.Bucket.Headers["Trailer"] {
+			for _, name := range strings.Split(names, ",") {
+				name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+				if name != "" {
+					stream.Bucket.Trailer[name] = nil
+				}
 			}
 		}
+	}
 
-		if frame.Header().Flags&END_STREAM == END_STREAM {
-			go stream.CallBack(stream)
+	if flags&END_STREAM == END_STREAM {
+		stream.Bucket.Body.CloseWithError(io.EOF)
+	}
+
+	if flags&END_HEADERS == END_HEADERS {
+		stream.called = true
+		go func() {
+			defer stream.Conn.handlerDone(stream)
+			stream.CallBack(stream)
+		}()
+	}
+}
+
+// ReadTrailer adds trailer to Bucket before body reaches EOF,
+// so that reader can see trailer after reading whole body.
+func (stream *Stream) ReadTrailer(trailer http.Header, flags Flag) {
+	if flags&END_STREAM != END_STREAM {
+		msg := "trailers without END_STREAM"
+		stream.Conn.ResetStream(stream, &StreamError{stream.ID, PROTOCOL_ERROR, msg})
+		return
+	}
+
+	for name, values := range trailer {
+		// pseudo header is not allowed in trailers
+		if strings.HasPrefix(name, ":") {
+			Error("pseudo header %s in trailers", name)
+			continue
+		}
+		for _, value := range values {
+			stream.Bucket.Trailer.Add(name, value)
 		}
 	}
+
+	stream.Bucket.Body.CloseWithError(io.EOF)
 }
 
+// ReadBody is called when n byte of body was read,
+// and send WINDOW_UPDATE for it.
+func (stream *Stream) ReadBody(n int) {
+	stream.Conn.WindowConsume(int32(n))
+
+	// no more DATA Frame will come
+	state := stream.GetState()
+	if state == HALF_CLOSED_REMOTE || state == CLOSED {
+		return
+	}
+	stream.WindowUpdate(int32(n))
+}
+
+// ReadLoop reads frames passed from conn.ReadLoop
+// until stream is closed, or finished after
+// last frame from peer (END_STREAM or RST_STREAM) was read.
 func (stream *Stream) ReadLoop() {
 	Debug("start stream (%d) ReadLoop()", stream.ID)
-	for f := range stream.ReadChan {
-		stream.Read(f)
+	defer close(stream.stopped)
+
+	// slot for handler is released here if it was never called
+	defer func() {
+		if !stream.called {
+			stream.Conn.handlerDone(stream)
+		}
+	}()
+
+	finished := stream.finished
+	var remoteClosed, localClosed bool
+	for {
+		select {
+		case f := <-stream.ReadChan:
+			stream.Read(f)
+			remoteClosed = remoteClosed || lastFrame(f)
+		case <-stream.done:
+			Debug("stop stream (%d) ReadLoop()", stream.ID)
+			return
+		case <-finished:
+			// last frame may be on the way yet
+			finished, localClosed = nil, true
+		}
+		if remoteClosed && localClosed {
+			Debug("finish stream (%d) ReadLoop()", stream.ID)
+			return
+		}
+	}
+}
+
+// lastFrame reports whether peer sends no more frame
+// which needs to be read after f.
+func lastFrame(f Frame) bool {
+	switch f.(type) {
+	case *HeadersFrame, *DataFrame:
+		return f.Header().Flags&END_STREAM == END_STREAM
+	case *RstStreamFrame:
+		return true
 	}
-	Debug("stop stream (%d) ReadLoop()", stream.ID)
+	return false
 }
 
-func (stream *Stream) Write(frame Frame) {
+// finish stops ReadLoop after last frame from peer was read,
+// without failing body nor Err.
+func (stream *Stream) finish() {
+	stream.finishOnce.Do(func() {
+		close(stream.finished)
+	})
+}
+
+// Deliver passes frame to ReadLoop of stream,
+// frame is dropped if stream was closed.
+func (stream *Stream) Deliver(frame Frame) {
+	select {
+	case stream.ReadChan <- frame:
+	case <-stream.done:
+		Debug("drop %v frame for closed stream(%d)", frame.Header().Type, stream.ID)
+	case <-stream.stopped:
+		Debug("drop %v frame for closed stream(%d)", frame.Header().Type, stream.ID)
+	}
+}
+
+// Write sends frame,
+// or drops it and returns error if stream was closed.
+func (stream *Stream) Write(frame Frame) error {
 	Trace("stream.Write (%v)", frame)
-	if stream.Closed {
-		return
+	stream.writeMu.Lock()
+	defer stream.writeMu.Unlock()
+	if stream.IsClosed() {
+		Debug("drop frame for closed stream(%d)", stream.ID)
+		return fmt.Errorf("stream(%d) was closed", stream.ID)
 	}
+	stream.write(frame)
+	return nil
+}
+
+// write sends frame, caller should hold writeMu
+// and check stream is not closed.
+func (stream *Stream) write(frame Frame) {
 	stream.ChangeState(frame, SEND)
-	stream.WriteChan <- frame
+	stream.Conn.Write(frame)
+
+	// stream closed by sending frame is removed from conn
+	if stream.GetState() == CLOSED {
+		reason := closedByEndStream
+		if frame.Header().Type == RstStreamFrameType {
+			reason = closedByResetSent
+		}
+		stream.Conn.closeStream(stream, reason)
+	}
+}
+
+// Send header as HEADERS Frame
+// and CONTINUATION Frames if needed
+func (stream *Stream) WriteHeaders(header http.Header, flags Flag) error {
+	return stream.WriteHeaderBlock(header, flags, 0, func(flags Flag, fragment []byte) Frame {
+		headersFrame := NewHeadersFrame(flags, stream.ID, nil, fragment, nil)
+		headersFrame.Headers = header
+		return headersFrame
+	})
+}
+
+// Send header of promised request as PUSH_PROMISE Frame
+// and CONTINUATION Frames if needed
+func (stream *Stream) WritePushPromise(promisedID uint32, header http.Header) error {
+	// 4 byte of Promised Stream ID is in payload
+	return stream.WriteHeaderBlock(header, END_HEADERS, 4, func(flags Flag, fragment []byte) Frame {
+		pushPromiseFrame := NewPushPromiseFrame(flags, stream.ID, promisedID, fragment, nil)
+		pushPromiseFrame.Headers = header
+		return pushPromiseFrame
+	})
+}
+
+// WriteHeaderBlock encodes header, and sends it in the first frame
+// made by newFrame followed by CONTINUATION Frames,
+// each of which fits in peer's MAX_FRAME_SIZE.
+// encoding and sending are done in lock of connection,
+// so that order of header blocks is the same as HPACK context
+// and no other frame is written between them.
+// header of closed stream is not encoded but returns error,
+// and stream is not closed by reset until encoded block is sent,
+// otherwise HPACK context of peer gets out of sync.
+func (stream *Stream) WriteHeaderBlock(header http.Header, flags Flag, overhead int32, newFrame func(flags Flag, fragment []byte) Frame) error {
+	stream.Conn.headerMu.Lock()
+	defer stream.Conn.headerMu.Unlock()
+	stream.writeMu.Lock()
+	defer stream.writeMu.Unlock()
+
+	if stream.IsClosed() {
+		Debug("drop header block for closed stream(%d)", stream.ID)
+		return fmt.Errorf("stream(%d) was closed before header block", stream.ID)
+	}
+
+	block := stream.Conn.EncodeHeader(header)
+	maxFrameSize := stream.Conn.PeerSetting(SETTINGS_MAX_FRAME_SIZE)
+
+	size := maxFrameSize - overhead
+	if int32(len(block)) <= size {
+		stream.write(newFrame(flags, block))
+		return nil
+	}
+
+	// END_HEADERS only on the last CONTINUATION
+	frames := Frames{newFrame(flags&^END_HEADERS, block[:size])}
+	block = block[size:]
+
+	for len(block) > 0 {
+		size = maxFrameSize
+		var f Flag = UNSET
+		if int32(len(block)) <= size {
+			size = int32(len(block))
+			f = END_HEADERS
+		}
+		frames = append(frames, NewContinuationFrame(f, stream.ID, block[:size]))
+		block = block[size:]
+	}
+
+	stream.write(frames)
+	return nil
+}
+
+// Send data as DATA Frames
+// each DataFrame has data in window size and MAX_FRAME_SIZE.
+// size of each frame is charged against both stream and connection window,
+// and it blocks until WINDOW_UPDATE gives room.
+// it returns when all data was sent or stream was closed.
+func (stream *Stream) WriteData(data []byte, flags Flag) (n int, err error) {
+	return stream.WriteDataContext(context.Background(), data, flags)
+}
+
+// WriteDataContext is WriteData which stops waiting window
+// when ctx is done.
+func (stream *Stream) WriteDataContext(ctx context.Context, data []byte, flags Flag) (n int, err error) {
+	maxFrameSize := stream.Conn.PeerSetting(SETTINGS_MAX_FRAME_SIZE)
+	rest := int32(len(data))
+	frameSize := rest
+
+	// no data but flags (END_STREAM) in empty DATA Frame
+	if rest == 0 && flags != UNSET {
+		return 0, stream.Write(NewDataFrame(flags, stream.ID, nil, nil))
+	}
+
+	// MaxFrameSize を基準に考え、そこから送れるサイズまで減らして行く
+	for rest > 0 {
+		Debug("rest data size(%v), current peer(%v) window(%v)", rest, stream.ID, stream.Window)
+
+		// MaxFrameSize より大きいなら切り詰める
+		frameSize = rest
+		if frameSize > maxFrameSize {
+			frameSize = maxFrameSize
+		}
+
+		// both stream and connection window limit the size
+		frameSize, err = stream.Conn.ReserveWindow(ctx, stream, frameSize)
+		if err != nil {
+			return n, err
+		}
+
+		Debug("send %v/%v data", frameSize, rest)
+
+		// flags (END_STREAM) only for last frame
+		var f Flag = UNSET
+		if rest == frameSize {
+			f = flags
+		}
+
+		// ここまでに算出した frameSize 分のデータを DATA Frame を作って送る
+		dataToSend := make([]byte, frameSize)
+		copy(dataToSend, data[n:n+int(frameSize)])
+		dataFrame := NewDataFrame(f, stream.ID, dataToSend, nil)
+		if err := stream.Write(dataFrame); err != nil {
+			// 送られなかった分の connection window は返す
+			stream.Conn.Window.Release(frameSize)
+			return n, err
+		}
+
+		// 送った分を削る
+		rest -= frameSize
+		n += int(frameSize)
+	}
+
+	return n, nil
 }
 
 func (stream *Stream) WindowUpdate(length int32) {
@@ -146,25 +449,136 @@ func (stream *Stream) WindowUpdate(length int32) {
 	}
 }
 
+// Close stops ReadLoop of stream and fails body.
+// it can be called more than once from any goroutine.
+// ReadChan is not closed, because conn.ReadLoop may send to it,
+// frames for closed stream are dropped in Deliver.
 func (stream *Stream) Close() {
-	Debug("stream(%d) Close()", stream.ID)
-	// stream.WriteChan は conn.WriteChan であり
-	// conn の方で close するので
-	// ここでは close しない
+	stream.CloseWithError(fmt.Errorf("stream(%d) was closed", stream.ID))
+}
+
+// CloseWithError closes stream with err,
+// which is returned from body and Err.
+func (stream *Stream) CloseWithError(err error) {
+	stream.mu.Lock()
+	if stream.Closed {
+		stream.mu.Unlock()
+		return
+	}
+	Debug("stream(%d) Close() with %v", stream.ID, err)
 	stream.Closed = true
-	Info("close stream(%v).ReadChan", stream.ID)
-	close(stream.ReadChan)
+	stream.err = err
+	stream.Bucket.Body.CloseWithError(err)
+	close(stream.done)
+	stream.mu.Unlock()
+
+	// wake up sender waiting window
+	stream.Window.Close()
+}
+
+// newContext returns context which is canceled when stream was closed
+// by RST_STREAM or closing connection, or when cancel was called.
+func (stream *Stream) newContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	go func() {
+		select {
+		case <-stream.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// Reset changes state to CLOSED and closes stream by err,
+// after RST_STREAM was sent or received.
+func (stream *Stream) Reset(err error) {
+	stream.mu.Lock()
+	if stream.State != CLOSED {
+		stream.changeState(CLOSED)
+	}
+	stream.mu.Unlock()
+	stream.CloseWithError(err)
+}
+
+// checkReceiveWindow counts DATA against stream window we advertised,
+// peer sending over it is stream error FLOW_CONTROL_ERROR (RFC 7540 6.9.1).
+func (stream *Stream) checkReceiveWindow(frame Frame) *StreamError {
+	if frame.Header().Type != DataFrameType {
+		return nil
+	}
+	length := int32(frame.Header().Length)
+	if stream.Window.Receive(length, stream.Conn.windowAllowance()) {
+		return nil
+	}
+	msg := fmt.Sprintf("DATA %d byte over stream window", length)
+	return &StreamError{stream.ID, FLOW_CONTROL_ERROR, msg}
+}
+
+// checkContentLength checks length of DATA against
+// content-length of request (RFC 7540 8.1.2.6).
+// response is not checked, because content-length of
+// response to HEAD doesn't match its DATA.
+func (stream *Stream) checkContentLength(frame Frame) *StreamError {
+	if stream.Conn.client {
+		return nil
+	}
+
+	switch f := frame.(type) {
+	case *HeadersFrame:
+		// trailer doesn't have content-length
+		if stream.receivedLength > 0 || stream.contentLength >= 0 {
+			break
+		}
+		value := f.Headers.Get("content-length")
+		if value == "" {
+			break
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			return &StreamError{stream.ID, PROTOCOL_ERROR, fmt.Sprintf("invalid content-length %q", value)}
+		}
+		stream.contentLength = n
+	case *DataFrame:
+		stream.receivedLength += int64(len(f.Data))
+	default:
+		return nil
+	}
+
+	if stream.contentLength < 0 {
+		return nil
+	}
+	if stream.receivedLength > stream.contentLength ||
+		frame.Header().Flags&END_STREAM == END_STREAM && stream.receivedLength != stream.contentLength {
+		msg := fmt.Sprintf("DATA length %d doesn't match content-length %d", stream.receivedLength, stream.contentLength)
+		return &StreamError{stream.ID, PROTOCOL_ERROR, msg}
+	}
+	return nil
+}
+
+// Err returns reason of close, or nil if not closed
+func (stream *Stream) Err() error {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	return stream.err
+}
+
+// Active reports whether stream counts toward
+// SETTINGS_MAX_CONCURRENT_STREAMS
+func (stream *Stream) Active() bool {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	return stream.State != CLOSED && !stream.Closed
 }
 
-// Encode Header using HPACK
-func (stream *Stream) EncodeHeader(header http.Header) []byte {
-	headerList := hpack.ToHeaderList(header)
-	Trace("sending header list %s", headerList)
-	return stream.HpackContext.Encode(*headerList)
+func (stream *Stream) IsClosed() bool {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	return stream.Closed
 }
 
-// Decode Header using HPACK
-func (stream *Stream) DecodeHeader(headerBlockFragment []byte) http.Header {
-	stream.HpackContext.Decode(headerBlockFragment)
-	return stream.HpackContext.ES.ToHeader()
+func (stream *Stream) GetState() State {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	return stream.State
 }
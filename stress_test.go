@@ -0,0 +1,139 @@
+package http2
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	. "github.com/Jxck/http2/frame"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer serves handler over TLS with h2 on random port
+func testServer(t *testing.T, handler http.Handler) (url string, stop func()) {
+	cert, err := tls.LoadX509KeyPair("keys/cert.pem", "keys/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &http.Server{
+		Handler:      handler,
+		TLSNextProto: TLSNextProto,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{VERSION},
+		},
+	}
+	go server.ServeTLS(listener, "", "")
+
+	return "https://" + listener.Addr().String(), func() { server.Close() }
+}
+
+func testTransport() *Transport {
+	return &Transport{
+		CertPath: "keys/cert.pem",
+		KeyPath:  "keys/key.pem",
+	}
+}
+
+// many streams are multiplexed on one connection,
+// each of them uploads and downloads body larger than
+// initial window so that flow control works concurrently.
+// run with -race.
+func TestConcurrentStreams(t *testing.T) {
+	url, stop := testServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		// echo body twice
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(body)
+		w.Write(body)
+	}))
+	defer stop()
+
+	client := &http.Client{Transport: testTransport()}
+
+	concurrency := 30
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			size := DEFAULT_INITIAL_WINDOW_SIZE/2 + i*1000
+			body := bytes.Repeat([]byte{byte('a' + i%26)}, size)
+
+			res, err := client.Post(fmt.Sprintf("%s/%d", url, i), "text/plain", bytes.NewReader(body))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer res.Body.Close()
+
+			got, err := ioutil.ReadAll(res.Body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			expected := append(body, body...)
+			if !bytes.Equal(got, expected) {
+				t.Errorf("stream %d: got %d byte, want %d byte", i, len(got), len(expected))
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// ReadLoop of stream finishes after stream was closed,
+// goroutines don't grow with requests on one connection.
+func TestStreamReadLoopFinish(t *testing.T) {
+	url, stop := testServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.Write([]byte("hello"))
+	}))
+	defer stop()
+
+	client := &http.Client{Transport: testTransport()}
+	get := func() {
+		res, err := client.Post(url, "text/plain", bytes.NewReader([]byte("body")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+
+	// connection is opened by first request
+	get()
+	before := runtime.NumGoroutine()
+
+	requests := 100
+	for i := 0; i < requests; i++ {
+		get()
+	}
+
+	// goroutines of last stream may not finished yet
+	var after int
+	for i := 0; i < 50; i++ {
+		after = runtime.NumGoroutine()
+		if after < before+requests/10 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("goroutines grew from %d to %d after %d requests", before, after, requests)
+}
@@ -1,31 +1,101 @@
 package http2
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	. "github.com/Jxck/color"
 	. "github.com/Jxck/http2/frame"
 	. "github.com/Jxck/logger"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 // Transport implements http.RoundTriper
 // with RoundTrip(request) response
+// connections are pooled by authority and
+// concurrent requests are multiplexed on them as streams.
 type Transport struct {
-	Conn     *Conn
 	CertPath string
 	KeyPath  string
+
+	// server push is refused by default
+	PushPolicy  PushPolicy
+	PushHandler PushHandler
+	PushCache   *PushCache
+
+	// SETTINGS_MAX_CONCURRENT_STREAMS advertised to server,
+	// which limits pushed streams. DEFAULT_MAX_CONCURRENT_STREAMS if 0.
+	// streams opened by client are limited by the value of server,
+	// and new connection is used when all connections reached it
+	// up to MaxConnsPerHost.
+	MaxConcurrentStreams int32
+
+	// connections to each authority are limited to MaxConnsPerHost,
+	// and requests wait a stream when all of them reached
+	// MAX_CONCURRENT_STREAMS of server. DefaultMaxConnsPerHost if 0.
+	MaxConnsPerHost int
+
+	// SETTINGS advertised to server, over DefaultSettings.
+	// PushPolicy and MaxConcurrentStreams are preferred if both are set.
+	Settings Settings
+
+	// PING is sent when connection is idle for PingInterval,
+	// and connection is closed if its ACK does not come back within PingTimeout.
+	// keepalive is disabled if PingInterval is 0. PingTimeout is 15s if 0.
+	PingInterval time.Duration
+	PingTimeout  time.Duration
+
+	// connection is closed with GOAWAY SETTINGS_TIMEOUT
+	// if server doesn't ACK SETTINGS in it. no timeout if 0.
+	// first SETTINGS of server is also waited up to it, 10s if 0.
+	SettingsTimeout time.Duration
+
+	// budgets of frames from server against resource exhaustion attacks,
+	// DefaultLimits are used for zero values.
+	Limits Limits
+
+	mu      sync.Mutex
+	conns   map[string][]*Conn   // authority => connections
+	dialing map[string]*dialCall // authority => dial in progress
+}
+
+// dialCall is connecting to authority,
+// requests waiting new connection share it.
+type dialCall struct {
+	done chan struct{}
+	err  error
+}
+
+// time to wait the first SETTINGS of server if SettingsTimeout is 0
+var defaultSettingsWait = 10 * time.Second
+
+// connections to each authority if MaxConnsPerHost is 0
+const DefaultMaxConnsPerHost = 4
+
+// interval to check connections can take new stream
+// while requests are waiting in GetConn
+var connWaitInterval = 10 * time.Millisecond
+
+func (transport *Transport) maxConnsPerHost() int {
+	if transport.MaxConnsPerHost > 0 {
+		return transport.MaxConnsPerHost
+	}
+	return DefaultMaxConnsPerHost
 }
 
 // connect tcp connection with host
-func (transport *Transport) Connect(url *URL) (err error) {
+func (transport *Transport) Connect(url *URL) (Conn *Conn, err error) {
 	address := url.Host + ":" + url.Port
 
 	// loading key pair
 	cert, err := tls.LoadX509KeyPair(transport.CertPath, transport.KeyPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// setting TLS config
@@ -36,7 +106,7 @@ func (transport *Transport) Connect(url *URL) (err error) {
 	}
 	conn, err := tls.Dial("tcp", address, &config)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// check connection state
@@ -44,35 +114,283 @@ func (transport *Transport) Connect(url *URL) (err error) {
 	Info("%v %v", Yellow("handshake"), state.HandshakeComplete)
 	Info("%v %v", Yellow("protocol"), state.NegotiatedProtocol)
 
-	Conn := NewConn(conn)
+	Conn = NewConn(conn)
+	Conn.client = true
+	Conn.authority = address
+	Conn.PushCallBack = transport.PushCallBack
 
 	// send Magic Octet
 	err = Conn.WriteMagic()
 	if err != nil {
-		return err
+		conn.Close()
+		return nil, err
 	}
 
 	go Conn.WriteLoop()
 
-	// send default settings to id 0
-	settingsFrame := NewSettingsFrame(UNSET, 0, DefaultSettings)
-	Conn.WriteChan <- settingsFrame
-	transport.Conn = Conn
+	// send settings to id 0
+	// with SETTINGS_ENABLE_PUSH=0 if push is refused
+	settings := DefaultSettings.Clone()
+	settings.Merge(transport.Settings)
+	if transport.PushPolicy == PushRefuse {
+		settings[SETTINGS_ENABLE_PUSH] = 0
+	}
+	if transport.MaxConcurrentStreams > 0 {
+		settings[SETTINGS_MAX_CONCURRENT_STREAMS] = transport.MaxConcurrentStreams
+	}
+	Conn.SettingsTimeout = transport.SettingsTimeout
+	Conn.Limits = transport.Limits
+	err = Conn.SendSettings(settings)
+	if err != nil {
+		Conn.closeRW()
+		return nil, err
+	}
+
+	// remove from pool and close when connection stops reading
+	authority := address
+	// Conn is cleared when returned with error
+	reader := Conn
+	go func() {
+		reader.ReadLoop()
+		transport.RemoveConn(authority, reader)
+		reader.closeRW()
+	}()
+
+	if transport.PingInterval > 0 {
+		go Conn.KeepAlive(transport.PingInterval, transport.PingTimeout)
+	}
+
+	// wait SETTINGS of server, so that new streams
+	// do not exceed its SETTINGS_MAX_CONCURRENT_STREAMS
+	wait := transport.SettingsTimeout
+	if wait <= 0 {
+		wait = defaultSettingsWait
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-Conn.PeerSettingsReceived():
+	case <-Conn.closed:
+		return nil, fmt.Errorf("connection to %s closed before SETTINGS", address)
+	case <-timer.C:
+		Conn.closeRW()
+		return nil, fmt.Errorf("SETTINGS from %s did not arrive in %v", address, wait)
+	}
 
-	go Conn.ReadLoop()
+	return Conn, nil
+}
 
-	return
+// GetConn returns pooled connection for authority
+// with a stream reserved on it, or connect new one.
+// pool is changed in lock of transport.mu, but connecting is done
+// out of it and requests for the same authority wait the one dial.
+// when connections reached MaxConnsPerHost, it waits
+// one of them takes new stream.
+// caller should call releaseStream after it added the stream.
+func (transport *Transport) GetConn(url *URL) (*Conn, error) {
+	return transport.GetConnContext(context.Background(), url)
 }
 
+// GetConnContext is GetConn which stops waiting connection
+// when ctx is done.
+func (transport *Transport) GetConnContext(ctx context.Context, url *URL) (*Conn, error) {
+	authority := url.Host + ":" + url.Port
+
+	for {
+		transport.mu.Lock()
+		conn := transport.pooledConn(authority)
+		if conn != nil {
+			transport.mu.Unlock()
+			return conn, nil
+		}
+
+		// all connections reached MAX_CONCURRENT_STREAMS,
+		// received GOAWAY or exhausted stream ids, so connect new one
+		// or wait the dial in progress
+		call, dialing := transport.dialing[authority]
+		if dialing {
+			transport.mu.Unlock()
+			<-call.done
+			if call.err != nil {
+				return nil, call.err
+			}
+			continue
+		}
+		if len(transport.conns[authority]) >= transport.maxConnsPerHost() {
+			transport.mu.Unlock()
+			Debug("wait stream of connections to %s", authority)
+			select {
+			case <-time.After(connWaitInterval):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			continue
+		}
+		call = &dialCall{done: make(chan struct{})}
+		if transport.dialing == nil {
+			transport.dialing = make(map[string]*dialCall)
+		}
+		transport.dialing[authority] = call
+		transport.mu.Unlock()
+
+		conn, err := transport.Connect(url)
+
+		transport.mu.Lock()
+		delete(transport.dialing, authority)
+		call.err = err
+		close(call.done)
+		if err != nil {
+			transport.mu.Unlock()
+			return nil, err
+		}
+		if transport.conns == nil {
+			transport.conns = make(map[string][]*Conn)
+		}
+		transport.conns[authority] = append(transport.conns[authority], conn)
+		Debug("new connection to %s, total (%d)", authority, len(transport.conns[authority]))
+		reserved := conn.reserveStream()
+		transport.mu.Unlock()
+
+		// waiting requests may take all streams of new connection
+		if reserved {
+			return conn, nil
+		}
+	}
+}
+
+// pooledConn returns connection for authority with a stream reserved,
+// or nil if no connection can take new stream.
+// caller should hold transport.mu.
+func (transport *Transport) pooledConn(authority string) *Conn {
+	// connection closed (e.g. by keepalive) before its ReadLoop
+	// removes it, and connection received GOAWAY are removed from pool.
+	// streams on the latter continue until server closes it,
+	// then ReadLoop finishes and it is closed.
+	// connection exhausted stream ids is retired with
+	// GOAWAY, and closed after its streams finished.
+	conns := transport.conns[authority][:0]
+	for _, conn := range transport.conns[authority] {
+		if conn.IsClosed() {
+			Debug("remove closed connection to %s", authority)
+			continue
+		}
+		if conn.GoingAway() {
+			Debug("remove connection to %s received GOAWAY", authority)
+			continue
+		}
+		if conn.StreamIDExhausted() {
+			Info("retire connection to %s, stream ids are exhausted", authority)
+			go conn.Shutdown(context.Background())
+			continue
+		}
+		conns = append(conns, conn)
+	}
+	if len(conns) > 0 {
+		transport.conns[authority] = conns
+	} else {
+		delete(transport.conns, authority)
+	}
+
+	for _, conn := range conns {
+		if conn.reserveStream() {
+			return conn
+		}
+	}
+	return nil
+}
+
+// RemoveConn removes connection from pool
+func (transport *Transport) RemoveConn(authority string, conn *Conn) {
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+
+	conns := transport.conns[authority]
+	for i, c := range conns {
+		if c == conn {
+			transport.conns[authority] = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(transport.conns[authority]) == 0 {
+		delete(transport.conns, authority)
+	}
+	Debug("remove connection to %s", authority)
+}
+
+// times to retry request not processed by server because of GOAWAY
+const maxRetry = 3
+
 // http.RoundTriper implementation
+// request on stream over last stream id of GOAWAY was not processed by server,
+// so it is retried on new connection if it is idempotent and body can be read again.
 func (transport *Transport) RoundTrip(req *http.Request) (res *http.Response, err error) {
+	body := req.Body
+	for retry := 0; ; retry++ {
+		res, err = transport.roundTrip(cloneRequest(req, body))
+		// request was not sent, so it is sent on new connection as it is
+		if (err == ErrStreamIDExhausted || err == ErrConnClosed) && retry < maxRetry {
+			continue
+		}
+		if _, ok := err.(*GoAwayError); !ok || retry >= maxRetry || !isIdempotent(req.Method) {
+			break
+		}
+		if body != nil && body != http.NoBody {
+			if req.GetBody == nil {
+				break
+			}
+			if body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		Info("retry request (%d) on new connection", retry+1)
+	}
+	if res != nil {
+		res.Request = req
+	}
+	return res, err
+}
+
+// cloneRequest copies req with its header,
+// so that headers for HTTP/2 are not added to request of caller,
+// and request can be sent again.
+func cloneRequest(req *http.Request, body io.ReadCloser) *http.Request {
+	r := new(http.Request)
+	*r = *req
+	r.Body = body
+	r.Header = make(http.Header, len(req.Header))
+	for name, values := range req.Header {
+		r.Header[name] = append([]string(nil), values...)
+	}
+	return r
+}
+
+// RFC 7231 4.2.2
+func isIdempotent(method string) bool {
+	switch method {
+	case "", "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// send req on a stream and wait response
+func (transport *Transport) roundTrip(req *http.Request) (res *http.Response, err error) {
 	// add headers
 	req.Header.Add("accept", "*/*")
 	req.Header.Add("x-http2-version", VERSION)
-	if req.ContentLength != 0 {
+	if req.ContentLength > 0 {
 		req.Header.Add("content-length", fmt.Sprintf("%d", req.ContentLength))
 	}
 
+	// declare keys of trailer sent after body
+	if len(req.Trailer) > 0 {
+		names := make([]string, 0, len(req.Trailer))
+		for name := range req.Trailer {
+			names = append(names, name)
+		}
+		req.Header.Set("trailer", strings.Join(names, ","))
+	}
+
 	Notice("\n%s", White(util.RequestString(req)))
 
 	url, err := NewURL(req.URL.String()) // err
@@ -80,33 +398,121 @@ func (transport *Transport) RoundTrip(req *http.Request) (res *http.Response, er
 		Error("%v", err)
 		return nil, err
 	}
+	// pushed response for this request
+	if transport.PushCache != nil && (req.Body == nil || req.Body == http.NoBody) {
+		res = transport.PushCache.Get(req)
+		if res != nil {
+			Info("response from push cache")
+			res.Request = req
+			return res, nil
+		}
+	}
+
 	req = util.UpgradeRequest(req, url)
 
-	// establish tcp connection and handshake
-	err = transport.Connect(url)
+	// each request has its own response channel
+	callback, response := TransportCallBack(req)
+
+	// choose connection with a stream reserved, so that
+	// connection does not exceed MAX_CONCURRENT_STREAMS.
+	// establish tcp connection and handshake if needed
+	conn, err := transport.GetConnContext(req.Context(), url)
 	if err != nil {
 		Error("%v", err)
 		return nil, err
 	}
 
-	callback, response := TransportCallBack(req)
-	transport.Conn.CallBack = callback
+	// creating stream and sending HEADERS are done
+	// in lock of connection, so that stream ids are sent in order
+	conn.openMu.Lock()
 
-	// create stream
-	stream := transport.Conn.NewStream(<-NextClientStreamID)
-	transport.Conn.Streams[stream.ID] = stream
+	// create stream with id of the connection
+	streamID, err := conn.NextStreamID()
+	if err != nil {
+		conn.openMu.Unlock()
+		conn.releaseStream()
+		Error("%v", err)
+		return nil, err
+	}
+	stream := NewStream(conn, streamID, callback)
+	err = conn.AddStream(stream)
+	conn.releaseStream()
+	if err != nil {
+		conn.openMu.Unlock()
+		stream.CloseWithError(err)
+		Error("%v", err)
+		return nil, err
+	}
+
+	// GOAWAY may be received after choosing connection
+	if err = conn.CheckGoAway(stream.ID); err != nil {
+		conn.openMu.Unlock()
+		stream.CloseWithError(err)
+		conn.closeStream(stream, closedByResetSent)
+		Error("%v", err)
+		return nil, err
+	}
+
+	// END_STREAM in HEADERS only if there is no body nor trailers
+	// ContentLength 0 with Body means unknown length
+	hasBody := req.Body != nil && req.Body != http.NoBody
+	hasBody = hasBody || len(req.Trailer) > 0
 
 	// send request header via HEADERS Frame
-	var flags Flag = END_STREAM + END_HEADERS
-	headerBlockFragment := stream.EncodeHeader(req.Header)
-	Trace("encoded header block %v", headerBlockFragment)
-	frame := NewHeadersFrame(flags, stream.ID, nil, headerBlockFragment, nil)
-	frame.Headers = req.Header
-	stream.Write(frame) // TODO: err
+	var flags Flag = END_HEADERS
+	if !hasBody {
+		flags += END_STREAM
+	}
+	err = stream.WriteHeaders(req.Header, flags)
+	conn.openMu.Unlock()
+	if err != nil {
+		// stream may be failed by GOAWAY or closed connection
+		if reason := stream.Err(); reason != nil {
+			err = reason
+		}
+		Error("%v", err)
+		return nil, err
+	}
 
-	res = <-response
+	// send request body via DATA Frame
+	// while waiting response, because server
+	// may respond before reading whole body
+	if hasBody {
+		go WriteRequestBody(req.Context(), stream, req.Body, req.Trailer)
+	}
 
-	stream.Close()
+	// response comes when HEADERS arrived
+	// and its body is read from stream after that.
+	// stream may be reset before it (e.g. REFUSED_STREAM),
+	// or canceled by context of request (e.g. http.Client.Timeout)
+	ctx := req.Context()
+	select {
+	case res = <-response:
+	case <-ctx.Done():
+		err = ctx.Err()
+		if !stream.IsClosed() {
+			conn.ResetStream(stream, &StreamError{stream.ID, CANCEL, err.Error()})
+		}
+		Error("%v", err)
+		return nil, err
+	case <-stream.done:
+		// GoAwayError if stream was not processed by server
+		err = stream.Err()
+		if _, ok := err.(*GoAwayError); !ok {
+			err = fmt.Errorf("stream(%d) was closed before response", stream.ID)
+		}
+		Error("%v", err)
+		return nil, err
+	case <-conn.closed:
+		// response may have arrived just before connection was closed
+		select {
+		case res = <-response:
+		default:
+			err = fmt.Errorf("connection was closed before response of stream(%d)", stream.ID)
+			Error("%v", err)
+			return nil, err
+		}
+	}
 
 	Notice("\n%s", White(util.ResponseString(res)))
 
@@ -116,8 +522,59 @@ func (transport *Transport) RoundTrip(req *http.Request) (res *http.Response, er
 	return res, nil
 }
 
+// send body as DATA Frames until EOF
+// and END_STREAM with last empty DATA Frame,
+// or with HEADERS Frame of trailer if there is.
+// if reading body fails or ctx is done, cancel stream with RST_STREAM.
+func WriteRequestBody(ctx context.Context, stream *Stream, body io.ReadCloser, trailer http.Header) {
+	if body != nil {
+		defer body.Close()
+	}
+
+	buf := make([]byte, stream.Conn.PeerSetting(SETTINGS_MAX_FRAME_SIZE))
+	for body != nil && body != http.NoBody {
+		n, err := body.Read(buf)
+		if n > 0 {
+			// blocks while window is not enough
+			_, werr := stream.WriteDataContext(ctx, buf[:n], UNSET)
+			if werr != nil {
+				Error("%v", werr)
+				if ctx.Err() != nil && !stream.IsClosed() {
+					stream.Conn.ResetStream(stream, &StreamError{stream.ID, CANCEL, ctx.Err().Error()})
+				}
+				return
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			Error("%v", err)
+			stream.Conn.ResetStream(stream, &StreamError{stream.ID, CANCEL, err.Error()})
+			return
+		}
+	}
+
+	// values of trailer are fixed after body reached EOF
+	sendTrailer := make(http.Header)
+	for name, values := range trailer {
+		if len(values) > 0 {
+			sendTrailer[name] = values
+		}
+	}
+	if len(sendTrailer) > 0 {
+		// End Stream in HEADERS Frame of trailer
+		stream.WriteHeaders(sendTrailer, END_HEADERS+END_STREAM)
+		return
+	}
+
+	// End Stream in empty DATA Frame
+	stream.WriteData(nil, END_STREAM)
+}
+
 func TransportCallBack(req *http.Request) (CallBack, chan *http.Response) {
-	response := make(chan *http.Response)
+	// buffered, RoundTrip may not receive it if stream was closed
+	response := make(chan *http.Response, 1)
 	return func(stream *Stream) {
 
 		body := stream.Bucket.Body
@@ -133,10 +590,10 @@ func TransportCallBack(req *http.Request) (CallBack, chan *http.Response) {
 			ProtoMinor:    1,
 			Header:        headers,
 			Body:          body,
-			ContentLength: int64(body.Len()),
+			ContentLength: util.ContentLength(headers),
 			// TransferEncoding []string
 			// Close bool
-			// Trailer Header
+			Trailer: stream.Bucket.Trailer,
 			Request: req,
 		}
 
@@ -0,0 +1,390 @@
+package http2
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/Jxck/hpack"
+	. "github.com/Jxck/http2/frame"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// the first connection sends GOAWAY after n requests arrived,
+// and responds only to the first one. following connections are served by Server.
+func testGoAwayServer(t *testing.T, n int) (url string, seen chan uint32, stop func()) {
+	cert, err := tls.LoadX509KeyPair("keys/cert.pem", "keys/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen = make(chan uint32, n)
+	var mu sync.Mutex
+	var first *tls.Conn
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("retried " + r.URL.Path))
+		}),
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{VERSION},
+		},
+	}
+	server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){
+		VERSION: func(s *http.Server, conn *tls.Conn, handler http.Handler) {
+			mu.Lock()
+			if first != nil {
+				mu.Unlock()
+				new(Server).TLSNextProtoHandler(s, conn, handler)
+				return
+			}
+			first = conn
+			mu.Unlock()
+
+			preface := make([]byte, len(CONNECTION_PREFACE))
+			io.ReadFull(conn, preface)
+			NewSettingsFrame(UNSET, 0, NilSettings).Write(conn)
+
+			settings := map[SettingsID]int32{SETTINGS_MAX_FRAME_SIZE: DEFAULT_MAX_FRAME_SIZE}
+			var streamIDs []uint32
+			for {
+				frame, err := ReadFrame(conn, settings)
+				if err != nil {
+					return
+				}
+				if frame.Header().Type != HeadersFrameType {
+					continue
+				}
+				streamID := frame.Header().StreamID
+				streamIDs = append(streamIDs, streamID)
+				seen <- streamID
+				if len(streamIDs) < n {
+					continue
+				}
+
+				// only the first stream is processed
+				NewGoAwayFrame(0, streamIDs[0], NO_ERROR, []byte("bye")).Write(conn)
+				header := hpack.ToHeaderList(http.Header{":status": {"200"}})
+				block := hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE)).Encode(*header)
+				NewHeadersFrame(END_HEADERS, streamIDs[0], nil, block, nil).Write(conn)
+				NewDataFrame(END_STREAM, streamIDs[0], []byte("processed"), nil).Write(conn)
+			}
+		},
+	}
+	go server.ServeTLS(listener, "", "")
+
+	return "https://" + listener.Addr().String(), seen, func() {
+		mu.Lock()
+		if first != nil {
+			first.Close()
+		}
+		mu.Unlock()
+		server.Close()
+	}
+}
+
+// streams over last stream id of GOAWAY fail with GoAwayError,
+// and only idempotent requests which can be sent again are retried on new connection.
+func TestGoAwayRetry(t *testing.T) {
+	url, seen, stop := testGoAwayServer(t, 4)
+	defer stop()
+	transport := testTransport()
+	client := &http.Client{Transport: transport}
+
+	type result struct {
+		body string
+		err  error
+	}
+	var requests = []struct {
+		name string
+		req  func() *http.Request
+		want string // body, or "" for GoAwayError
+	}{
+		{"processed", func() *http.Request {
+			req, _ := http.NewRequest("GET", url+"/processed", nil)
+			return req
+		}, "processed"},
+		{"idempotent", func() *http.Request {
+			req, _ := http.NewRequest("GET", url+"/idempotent", nil)
+			return req
+		}, "retried /idempotent"},
+		{"not idempotent", func() *http.Request {
+			req, _ := http.NewRequest("POST", url+"/post", bytes.NewReader([]byte("body")))
+			return req
+		}, ""},
+		{"not rewindable", func() *http.Request {
+			req, _ := http.NewRequest("PUT", url+"/put", ioutil.NopCloser(bytes.NewReader([]byte("body"))))
+			return req
+		}, ""},
+	}
+
+	// requests are sent in order of stream id
+	results := make([]chan result, len(requests))
+	for i, r := range requests {
+		results[i] = make(chan result, 1)
+		go func(req *http.Request, done chan result) {
+			res, err := client.Do(req)
+			if err != nil {
+				done <- result{"", err}
+				return
+			}
+			body, err := ioutil.ReadAll(res.Body)
+			done <- result{string(body), err}
+		}(r.req(), results[i])
+		<-seen
+	}
+
+	for i, r := range requests {
+		got := <-results[i]
+		if r.want != "" {
+			if got.err != nil || got.body != r.want {
+				t.Errorf("%s: got %q %v, want %q", r.name, got.body, got.err, r.want)
+			}
+			continue
+		}
+		var goAwayError *GoAwayError
+		if !errors.As(got.err, &goAwayError) {
+			t.Errorf("%s: got %q %v, want GoAwayError", r.name, got.body, got.err)
+		}
+	}
+
+	// connection going away is left out of pool
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	if len(transport.conns) != 1 {
+		t.Errorf("got connections to %d authorities, want 1", len(transport.conns))
+	}
+	for authority, conns := range transport.conns {
+		for _, conn := range conns {
+			if conn.GoingAway() {
+				t.Errorf("connection to %s going away is in pool", authority)
+			}
+		}
+		if len(conns) != 1 {
+			t.Errorf("got %d connections to %s, want 1", len(conns), authority)
+		}
+	}
+}
+
+// testRawServer accepts TLS connections and serves them with serve,
+// so that test can send frames as server.
+func testRawServer(t *testing.T, serve func(conn net.Conn)) (url string, stop func()) {
+	cert, err := tls.LoadX509KeyPair("keys/cert.pem", "keys/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{VERSION},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			go serve(conn)
+		}
+	}()
+
+	return "https://" + listener.Addr().String(), func() {
+		listener.Close()
+		mu.Lock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		mu.Unlock()
+	}
+}
+
+// push for other authority than connection is canceled,
+// and only push for the same one is cached.
+func TestPushAuthority(t *testing.T) {
+	reset := make(chan *RstStreamFrame, 10)
+	url, stop := testRawServer(t, func(conn net.Conn) {
+		preface := make([]byte, len(CONNECTION_PREFACE))
+		io.ReadFull(conn, preface)
+		NewSettingsFrame(UNSET, 0, NilSettings).Write(conn)
+
+		authority := conn.LocalAddr().String()
+		encoder := hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))
+		encode := func(header http.Header) []byte {
+			return encoder.Encode(*hpack.ToHeaderList(header))
+		}
+		promise := func(promisedID uint32, authority, path string) {
+			block := encode(http.Header{
+				":method":    {"GET"},
+				":scheme":    {"https"},
+				":authority": {authority},
+				":path":      {path},
+			})
+			NewPushPromiseFrame(END_HEADERS, 1, promisedID, block, nil).Write(conn)
+		}
+		respond := func(streamID uint32, body string) {
+			NewHeadersFrame(END_HEADERS, streamID, nil, encode(http.Header{":status": {"200"}}), nil).Write(conn)
+			NewDataFrame(END_STREAM, streamID, []byte(body), nil).Write(conn)
+		}
+
+		settings := map[SettingsID]int32{SETTINGS_MAX_FRAME_SIZE: DEFAULT_MAX_FRAME_SIZE}
+		for {
+			frame, err := ReadFrame(conn, settings)
+			if err != nil {
+				return
+			}
+			switch f := frame.(type) {
+			case *SettingsFrame:
+				if f.Flags != ACK {
+					NewSettingsFrame(ACK, 0, NilSettings).Write(conn)
+				}
+			case *RstStreamFrame:
+				reset <- f
+			case *HeadersFrame:
+				promise(2, "evil.example.com", "/evil")
+				promise(4, authority, "/pushed")
+				respond(4, "pushed")
+				respond(1, "index")
+			}
+		}
+	})
+	defer stop()
+
+	transport := testTransport()
+	transport.PushPolicy = PushAccept
+	transport.PushCache = NewPushCache()
+	client := &http.Client{Transport: transport}
+
+	res, err := client.Get(url + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != "index" {
+		t.Errorf("got %q, want %q", body, "index")
+	}
+
+	select {
+	case f := <-reset:
+		if f.StreamID != 2 || f.ErrorCode != CANCEL {
+			t.Errorf("got RST_STREAM %v for stream(%d), want CANCEL for stream(2)", f.ErrorCode, f.StreamID)
+		}
+	case <-time.After(3 * time.Second):
+		t.Errorf("push for other authority was not canceled")
+	}
+
+	evil, _ := http.NewRequest("GET", "https://evil.example.com/evil", nil)
+	if res := transport.PushCache.Get(evil); res != nil {
+		t.Errorf("push for other authority was cached")
+	}
+
+	// response of push is cached after its body was read
+	pushed, _ := http.NewRequest("GET", url+"/pushed", nil)
+	for i := 0; ; i++ {
+		if res := transport.PushCache.Get(pushed); res != nil {
+			body, _ := ioutil.ReadAll(res.Body)
+			if string(body) != "pushed" {
+				t.Errorf("got %q, want %q", body, "pushed")
+			}
+			break
+		}
+		if i > 100 {
+			t.Fatalf("push for the same authority was not cached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// connections are limited to MaxConnsPerHost, and requests
+// wait a stream when all of them reached MAX_CONCURRENT_STREAMS.
+func TestMaxConnsPerHost(t *testing.T) {
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			<-release
+		}
+		w.Write([]byte("ok"))
+	})
+	srv := &Server{Settings: Settings{SETTINGS_MAX_CONCURRENT_STREAMS: 1}}
+	var mu sync.Mutex
+	accepted := 0
+	url, stop := testRawServer(t, func(conn net.Conn) {
+		mu.Lock()
+		accepted++
+		mu.Unlock()
+		srv.ServeConn(conn, handler)
+	})
+	defer stop()
+
+	transport := testTransport()
+	transport.MaxConnsPerHost = 2
+	client := &http.Client{Transport: transport}
+
+	errs := make(chan error)
+	for i := 0; i < 2; i++ {
+		go func() {
+			res, err := client.Get(url + "/block")
+			if err == nil {
+				res.Body.Close()
+			}
+			errs <- err
+		}()
+	}
+
+	// both connections are busy, request gives up waiting by its context
+	time.Sleep(200 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequest("GET", url+"/", nil)
+	if _, err := client.Do(req.WithContext(ctx)); err == nil {
+		t.Errorf("request over MaxConnsPerHost didn't wait")
+	}
+
+	// waiting request takes stream released by another
+	done := make(chan error)
+	go func() {
+		res, err := client.Get(url + "/")
+		if err == nil {
+			res.Body.Close()
+		}
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("waiting request was not sent")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if accepted != 2 {
+		t.Errorf("got %d connections, want 2", accepted)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
@@ -30,29 +31,9 @@ var MustHeader = map[string]string{
 
 type Util struct{}
 
-var (
-	NextClientStreamID chan uint32 = util.NextID(1)
-	NextServerStreamID chan uint32 = util.NextID(2)
-)
-
-func (u Util) NextID(id uint32) chan uint32 {
-	idChan := make(chan uint32)
-	go func() {
-		for {
-			if id >= 4294967295 || id < 0 { // 2^32-1 or invalid
-				log.Println("stream id too big or invalid, return to 0")
-				id = 0
-			}
-			idChan <- id
-			id = id + 2
-		}
-	}()
-	return idChan
-}
-
 func (u Util) UpgradeRequest(req *http.Request, url *URL) *http.Request {
 	// TODO: manage header duplicat
-	req.Header.Add(":authority", url.Host)
+	req.Header.Add(":authority", req.URL.Host) // with port if specified
 	req.Header.Add(":method", req.Method)
 	req.Header.Add(":path", url.Path)
 	req.Header.Add(":scheme", url.Scheme)
@@ -75,6 +56,19 @@ func (u Util) ResponseString(res *http.Response) string {
 	return str
 }
 
+// returns content-length header value or -1 if unknown
+func (u Util) ContentLength(header http.Header) int64 {
+	cl := header.Get("content-length")
+	if cl == "" {
+		return -1
+	}
+	n, err := strconv.ParseInt(cl, 10, 64)
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
 func (u Util) Indent(v interface{}) string {
 	return strings.Replace(fmt.Sprintf("%v", v), "\n", "\n\t\t\t\t", -1)
 }
@@ -1,11 +1,13 @@
 package http2
 
 import (
+	"context"
 	"fmt"
 	. "github.com/Jxck/color"
 	. "github.com/Jxck/http2/frame"
 	. "github.com/Jxck/logger"
 	"log"
+	"sync"
 )
 
 func init() {
@@ -13,23 +15,26 @@ func init() {
 }
 
 type Window struct {
+	mu              sync.Mutex
 	initialSize     int32
 	currentSize     int32
 	threshold       int32
 	peerInitialSize int32
 	peerCurrentSize int32
 	peerThreshold   int32
+
+	// size peer can send until next WINDOW_UPDATE,
+	// which is checked when DATA Frame is received
+	recvSize int32
+
+	// senders waiting in Acquire are woken up by closing updated
+	// when peer window increased or window closed
+	updated chan struct{}
+	closed  bool
 }
 
 func NewWindowDefault() *Window {
-	return &Window{
-		initialSize:     DEFAULT_INITIAL_WINDOW_SIZE,
-		currentSize:     DEFAULT_INITIAL_WINDOW_SIZE,
-		threshold:       DEFAULT_INITIAL_WINDOW_SIZE/2 + 1,
-		peerInitialSize: DEFAULT_INITIAL_WINDOW_SIZE,
-		peerCurrentSize: DEFAULT_INITIAL_WINDOW_SIZE,
-		peerThreshold:   DEFAULT_INITIAL_WINDOW_SIZE/2 + 1,
-	}
+	return NewWindow(DEFAULT_INITIAL_WINDOW_SIZE, DEFAULT_INITIAL_WINDOW_SIZE)
 }
 
 func NewWindow(initialWindow, peerInitilaWindow int32) *Window {
@@ -40,37 +45,72 @@ func NewWindow(initialWindow, peerInitilaWindow int32) *Window {
 		peerInitialSize: peerInitilaWindow,
 		peerCurrentSize: peerInitilaWindow,
 		peerThreshold:   peerInitilaWindow/2 + 1,
+		recvSize:        initialWindow,
+		updated:         make(chan struct{}),
 	}
 }
 
 func (window *Window) UpdateInitialSize(newInitialWindowSize int32) {
-	currentInitialWindowSize := window.initialSize
+	window.mu.Lock()
+	defer window.mu.Unlock()
+
+	// SETTINGS_INITIAL_WINDOW_SIZE from peer changes peer window
+	currentInitialWindowSize := window.peerInitialSize
 	currentWindowSize := window.peerCurrentSize
-	newWindwoSize := newInitialWindowSize - (window.initialSize - currentWindowSize)
+	newWindwoSize := newInitialWindowSize - (currentInitialWindowSize - currentWindowSize)
 
 	window.peerCurrentSize = newWindwoSize
-	window.initialSize = newInitialWindowSize
+	window.peerInitialSize = newInitialWindowSize
+	window.peerThreshold = newInitialWindowSize/2 + 1
+	window.notify()
 
 	Trace(Brown(`update initial window size
-	"New WindowSize(%v)" = "New InitialWindowSize(%v)" - ("Current InitialWindow ize(%v)" - "Current WindowSize(%v)")`),
+	"New WindowSize(%v)" = "New InitialWindowSize(%v)" - ("Current InitialWindowSize(%v)" - "Current WindowSize(%v)")`),
 		newWindwoSize, newInitialWindowSize, currentInitialWindowSize, currentWindowSize)
 }
 
+// UpdateLocalInitialSize changes window we receive,
+// when our SETTINGS_INITIAL_WINDOW_SIZE was acknowledged.
+func (window *Window) UpdateLocalInitialSize(newInitialWindowSize int32) {
+	window.mu.Lock()
+	defer window.mu.Unlock()
+
+	currentInitialWindowSize := window.initialSize
+	window.currentSize += newInitialWindowSize - currentInitialWindowSize
+	window.recvSize += newInitialWindowSize - currentInitialWindowSize
+	window.initialSize = newInitialWindowSize
+	window.threshold = newInitialWindowSize/2 + 1
+
+	Trace(Brown("update local initial window size (%v) -> (%v), window size (%v)"),
+		currentInitialWindowSize, newInitialWindowSize, window.currentSize)
+}
+
 func (window *Window) Update(windowSizeIncrement int32) {
+	window.mu.Lock()
+	defer window.mu.Unlock()
+
 	current := window.currentSize
 	window.currentSize = current + windowSizeIncrement
+	window.recvSize += windowSizeIncrement
 
 	Trace(Brown("increment current window size (%v) + increment (%v) = (%v)"), current, windowSizeIncrement, window.currentSize)
 }
 
 func (window *Window) UpdatePeer(windowSizeIncrement int32) {
+	window.mu.Lock()
+	defer window.mu.Unlock()
+
 	current := window.peerCurrentSize
 	window.peerCurrentSize = current + windowSizeIncrement
+	window.notify()
 
 	Trace(Brown("increment peer window size (%v) + increment (%v) = (%v)"), current, windowSizeIncrement, window.peerCurrentSize)
 }
 
 func (window *Window) Consume(length int32) (update int32) {
+	window.mu.Lock()
+	defer window.mu.Unlock()
+
 	window.currentSize -= length
 
 	if window.currentSize < window.threshold {
@@ -80,21 +120,81 @@ func (window *Window) Consume(length int32) (update int32) {
 	return update
 }
 
-func (window *Window) ConsumePeer(length int32) {
-	current := window.peerCurrentSize
-	window.peerCurrentSize = current - length
+// Receive counts length of DATA Frame received against window
+// we advertised, and reports whether peer respected it.
+// allowance is increase of window which peer may already use.
+func (window *Window) Receive(length, allowance int32) bool {
+	window.mu.Lock()
+	defer window.mu.Unlock()
 
-	Trace(Brown("consume peer window size (%v) - (%v) = (%v)"), current, length, window.peerCurrentSize)
+	window.recvSize -= length
+	return window.recvSize+allowance >= 0
 }
 
-func (window *Window) Consumable(length int32) int32 {
-	if window.peerCurrentSize < length {
-		return window.peerCurrentSize
-	} else {
-		return length
+// Acquire consumes peer window up to length, and returns
+// the size which can be sent.
+// while peer window is exhausted, it blocks without spinning
+// until WINDOW_UPDATE arrives, ctx is done or window is closed.
+func (window *Window) Acquire(ctx context.Context, length int32) (int32, error) {
+	for {
+		window.mu.Lock()
+		if window.closed {
+			window.mu.Unlock()
+			return 0, fmt.Errorf("window was closed")
+		}
+		if window.peerCurrentSize > 0 {
+			if length > window.peerCurrentSize {
+				length = window.peerCurrentSize
+			}
+			window.peerCurrentSize -= length
+			Trace(Brown("acquire peer window size (%v) remains (%v)"), length, window.peerCurrentSize)
+			window.mu.Unlock()
+			return length, nil
+		}
+		updated := window.updated
+		window.mu.Unlock()
+
+		Debug("wait peer window update")
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
 	}
 }
 
+// Release gives back acquired size which was not sent
+func (window *Window) Release(length int32) {
+	window.mu.Lock()
+	defer window.mu.Unlock()
+
+	window.peerCurrentSize += length
+	window.notify()
+}
+
+// Close wakes up senders waiting in Acquire,
+// and following Acquire fails.
+func (window *Window) Close() {
+	window.mu.Lock()
+	defer window.mu.Unlock()
+
+	if window.closed {
+		return
+	}
+	window.closed = true
+	window.notify()
+}
+
+// notify wakes up senders waiting in Acquire.
+// caller should hold window.mu
+func (window *Window) notify() {
+	close(window.updated)
+	window.updated = make(chan struct{})
+}
+
 func (window *Window) String() string {
+	window.mu.Lock()
+	defer window.mu.Unlock()
+
 	return fmt.Sprintf(Yellow("window: curr(%d) - peer(%d)"), window.currentSize, window.peerCurrentSize)
 }